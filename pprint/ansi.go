@@ -0,0 +1,151 @@
+package pprint
+
+import (
+	"io"
+	"strings"
+)
+
+// A Theme says how to show annotated text on a terminal, as the
+// parameters of an SGR escape sequence for each annotation; "1;34" for
+// bold blue, for instance.  Annotations it doesn't mention are left
+// as they are.
+type Theme map[interface{}]string
+
+// DefaultTheme shows the usual tokens in colours that work on light
+// and dark terminals alike.
+var DefaultTheme = Theme{
+	KeywordToken: "1;34",
+	StringToken:  "32",
+	NumberToken:  "36",
+	CommentToken: "2",
+	ErrorToken:   "1;31",
+}
+
+// An ANSISink colours text according to the annotations it's in, using
+// ANSI escape sequences.  Colours are only on while there's text to
+// show, never for line breaks or indentation, so nothing bleeds into
+// the margin.  The escape sequences aren't part of the document, so
+// they don't count towards the width of anything.
+type ANSISink struct {
+	w     io.Writer
+	theme Theme
+	// styles holds the SGR parameters for each open annotation.
+	styles []string
+	// active is true if the terminal's showing some style, and
+	// `stale` if that isn't the one it should be anymore.
+	active, stale bool
+	// LineEnding is written at the end of each line; "\n" if it's
+	// empty.
+	LineEnding string
+}
+
+// NewANSISink returns an ANSISink which writes to `w` using `theme`.
+// If `theme` is nil, nothing is coloured; that's handy for when the
+// output isn't a terminal.
+func NewANSISink(w io.Writer, theme Theme) *ANSISink {
+	return &ANSISink{w: w, theme: theme}
+}
+
+// RenderANSI is like Render, but colours `doc` for a terminal with
+// `theme`.
+func RenderANSI(doc Element, out io.Writer, opts Options, theme Theme) error {
+	a := NewANSISink(out, theme)
+	a.LineEnding = opts.Newline
+	return RenderSink(doc, a, opts)
+}
+
+func (a *ANSISink) WriteText(text string) error {
+	if a.stale {
+		if err := a.restyle(); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(a.w, text)
+	return err
+}
+
+func (a *ANSISink) Newline(indent string) error {
+	if err := a.reset(); err != nil {
+		return err
+	}
+	if err := writeLineEnding(a.w, a.LineEnding); err != nil {
+		return err
+	}
+	_, err := io.WriteString(a.w, indent)
+	return err
+}
+
+// BeginAnnotation starts using the style for `ann`, on top of those
+// already in use.
+func (a *ANSISink) BeginAnnotation(ann interface{}) error {
+	style := a.lookup(ann)
+	a.styles = append(a.styles, style)
+	if style != "" {
+		a.stale = true
+	}
+	return nil
+}
+
+// EndAnnotation goes back to the styles in use before `ann`.
+func (a *ANSISink) EndAnnotation(ann interface{}) error {
+	style := a.styles[len(a.styles)-1]
+	a.styles = a.styles[:len(a.styles)-1]
+	if style != "" {
+		a.stale = true
+	}
+	return nil
+}
+
+// Flush leaves the terminal in its default style.
+func (a *ANSISink) Flush() error {
+	return a.reset()
+}
+
+// lookup finds the style for `ann` in the theme.  Annotations can be
+// anything at all, so one which can't be a map key just has no style.
+func (a *ANSISink) lookup(ann interface{}) (style string) {
+	if a.theme == nil {
+		return ""
+	}
+	defer func() {
+		if recover() != nil {
+			style = ""
+		}
+	}()
+	return a.theme[ann]
+}
+
+// style is the combination of all the styles in use.
+func (a *ANSISink) style() string {
+	var styles []string
+	for _, style := range a.styles {
+		if style != "" {
+			styles = append(styles, style)
+		}
+	}
+	return strings.Join(styles, ";")
+}
+
+// restyle switches the terminal to the current style.
+func (a *ANSISink) restyle() error {
+	a.stale = false
+	style := a.style()
+	if style == "" {
+		return a.reset()
+	}
+	a.active = true
+	_, err := io.WriteString(a.w, "\x1b[0;"+style+"m")
+	return err
+}
+
+// reset switches the terminal back to its default style, if it isn't
+// already.  The current style is put back before the next text.
+func (a *ANSISink) reset() error {
+	if !a.active {
+		return nil
+	}
+	a.active = false
+	a.stale = a.style() != ""
+	_, err := io.WriteString(a.w, "\x1b[0m")
+	return err
+}
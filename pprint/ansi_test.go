@@ -0,0 +1,69 @@
+package pprint
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestANSISink(t *testing.T) {
+	theme := Theme{KeywordToken: "1", StringToken: "32", "call": "4"}
+	handle := Concat(Annotate(KeywordToken, Text("if")), Text(" x {"),
+		Indent(2, Concat(LB, Annotate("call", Concat(Text("f("),
+			Nest(Concat(Annotate(StringToken, Text(`"a"`)), LB,
+				Annotate(NumberToken, Text("1")))), Text(")"))))),
+		LB, Text("}"))
+
+	buffer := new(bytes.Buffer)
+	err := RenderANSI(handle, buffer, Options{Width: 80}, theme)
+	if assert.NoError(t, err) {
+		// The call's underlining is put back after the string,
+		// but not in the indentation.
+		assert.Equal(t, "\x1b[0;1mif\x1b[0m x {\n"+
+			"  \x1b[0;4mf(\x1b[0;4;32m\"a\"\x1b[0m\n"+
+			"    \x1b[0;4m1)\x1b[0m\n"+
+			"}", buffer.String())
+	}
+
+	// Without a theme, the output is plain.
+	buffer.Reset()
+	err = RenderANSI(handle, buffer, Options{Width: 80}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "if x {\n  f(\"a\"\n    1)\n}", buffer.String())
+	}
+}
+
+func TestANSIWidth(t *testing.T) {
+	handle := Group(Concat(Annotate(KeywordToken, Text("return")), CondLB,
+		Annotate(NumberToken, Text("12345"))))
+
+	// Escape sequences don't count towards the width.
+	buffer := new(bytes.Buffer)
+	err := RenderANSI(handle, buffer, Options{Width: 12}, DefaultTheme)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "\x1b[0;1;34mreturn\x1b[0m \x1b[0;36m12345\x1b[0m",
+			buffer.String())
+	}
+}
+
+func TestANSIUnhashable(t *testing.T) {
+	type tagged struct {
+		tag interface{}
+	}
+	handle := Concat(Annotate([]string{"a"}, Text("x")),
+		Annotate(tagged{map[string]int{}}, Text("y")),
+		Annotate(KeywordToken, Text("z")))
+
+	// Annotations which can't be looked up in a theme aren't styled.
+	for _, theme := range []Theme{nil, DefaultTheme} {
+		buffer := new(bytes.Buffer)
+		err := RenderANSI(handle, buffer, Options{Width: 80}, theme)
+		if assert.NoError(t, err) {
+			expected := "xyz"
+			if theme != nil {
+				expected = "xy\x1b[0;1;34mz\x1b[0m"
+			}
+			assert.Equal(t, expected, buffer.String())
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package pprint
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// The channel based pipeline this package used to use is kept here so
+// that the benchmarks can compare the current renderer against it.  It
+// only understands the original document primitives.
+
+type chanKind uint8
+
+const (
+	chanText chanKind = iota
+	chanCond
+	chanCRLF
+	chanNBeg
+	chanNEnd
+	chanGBeg
+	chanGEnd
+)
+
+type chanElt struct {
+	kind              chanKind
+	hpos              int
+	payload           string
+	small, cont, tail string
+}
+
+func chanToStream(document Element) <-chan *chanElt {
+	ch := make(chan *chanElt)
+	go func() {
+		defer close(ch)
+		chanVisit(document, ch)
+	}()
+	return ch
+}
+
+func chanVisit(document Element, out chan<- *chanElt) {
+	switch doc := document.(type) {
+	case *text:
+		out <- &chanElt{kind: chanText, hpos: -1, payload: doc.text}
+	case *cond:
+		out <- &chanElt{kind: chanCond, hpos: -1, small: doc.small,
+			cont: doc.continuation, tail: doc.tail}
+	case *linebreak:
+		out <- &chanElt{kind: chanCRLF, hpos: -1}
+	case *concat:
+		for _, elt := range doc.children {
+			chanVisit(elt, out)
+		}
+	case *group:
+		out <- &chanElt{kind: chanGBeg, hpos: -1}
+		chanVisit(doc.child, out)
+		out <- &chanElt{kind: chanGEnd, hpos: -1}
+	case *nest:
+		out <- &chanElt{kind: chanNBeg, hpos: -1}
+		out <- &chanElt{kind: chanGBeg, hpos: -1}
+		chanVisit(doc.child, out)
+		out <- &chanElt{kind: chanGEnd, hpos: -1}
+		out <- &chanElt{kind: chanNEnd, hpos: -1}
+	default:
+		panic("Couldn't understand document type")
+	}
+}
+
+func chanAnnotateLastChar(in <-chan *chanElt) <-chan *chanElt {
+	ch := make(chan *chanElt)
+	go func() {
+		defer close(ch)
+		position := 0
+		for elt := range in {
+			switch elt.kind {
+			case chanText:
+				position += len(elt.payload)
+				elt.hpos = position
+			case chanCond:
+				position += len(elt.small)
+				elt.hpos = position
+			case chanGBeg, chanNBeg:
+			default:
+				elt.hpos = position
+			}
+			ch <- elt
+		}
+	}()
+	return ch
+}
+
+func chanAnnotateGBeg(in <-chan *chanElt) <-chan *chanElt {
+	ch := make(chan *chanElt)
+	go func() {
+		defer close(ch)
+		var lookahead [][]*chanElt
+		for element := range in {
+			switch element.kind {
+			case chanGBeg:
+				lookahead = append(lookahead, make([]*chanElt, 0))
+			case chanGEnd:
+				last := len(lookahead) - 1
+				top := lookahead[last]
+				lookahead = lookahead[:last]
+				gbeg := &chanElt{kind: chanGBeg, hpos: element.hpos}
+				if len(lookahead) == 0 {
+					ch <- gbeg
+					for _, e := range top {
+						ch <- e
+					}
+					ch <- element
+				} else {
+					last--
+					lookahead[last] = append(lookahead[last], gbeg)
+					lookahead[last] = append(lookahead[last], top...)
+					lookahead[last] = append(lookahead[last], element)
+				}
+			default:
+				if len(lookahead) == 0 {
+					ch <- element
+				} else {
+					last := len(lookahead) - 1
+					lookahead[last] = append(lookahead[last], element)
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func chanOutput(in <-chan *chanElt, width int, output io.Writer) error {
+	fittingElements := 0
+	rightEdge := width
+	hpos := 0
+	var indent []int
+	currentIndent := func() int {
+		if len(indent) == 0 {
+			return 0
+		}
+		return indent[len(indent)-1]
+	}
+	for elt := range in {
+		switch elt.kind {
+		case chanText:
+			io.WriteString(output, elt.payload)
+			hpos += len(elt.payload)
+		case chanCond:
+			if fittingElements == 0 {
+				io.WriteString(output, elt.tail)
+				io.WriteString(output, "\n")
+				io.WriteString(output, strings.Repeat(" ", currentIndent()))
+				io.WriteString(output, elt.cont)
+				hpos = currentIndent() + len(elt.cont)
+				rightEdge = (width - hpos) + elt.hpos
+			} else {
+				io.WriteString(output, elt.small)
+				hpos += len(elt.small)
+			}
+		case chanCRLF:
+			io.WriteString(output, "\n")
+			io.WriteString(output, strings.Repeat(" ", currentIndent()))
+			fittingElements = 0
+			hpos = currentIndent()
+			rightEdge = (width - hpos) + elt.hpos
+		case chanGBeg:
+			if fittingElements != 0 || elt.hpos <= rightEdge {
+				fittingElements++
+			} else {
+				fittingElements = 0
+			}
+		case chanGEnd:
+			if fittingElements != 0 {
+				fittingElements--
+			}
+		case chanNBeg:
+			indent = append(indent, hpos)
+		case chanNEnd:
+			if len(indent) > 0 {
+				indent = indent[:len(indent)-1]
+			}
+		}
+	}
+	return nil
+}
+
+func chanPrettyPrint(doc Element, width int, out io.Writer) error {
+	return chanOutput(chanAnnotateGBeg(chanAnnotateLastChar(chanToStream(doc))), width, out)
+}
+
+func benchDocument() Element {
+	return DottedList(Funcall("expr", Text("5")),
+		Funcall("add", DottedList(Funcall("expr", Text("7")),
+			Funcall("frob"))),
+		Funcall("mul", DottedList(Funcall("expr", Text("17"))),
+			Funcall("mul", DottedList(Funcall("expr", Text("17")))),
+			Funcall("mul", DottedList(Funcall("expr", Text("17"))))))
+}
+
+func TestChannelPipelineAgrees(t *testing.T) {
+	doc := benchDocument()
+	for _, width := range []int{4, 50, 180} {
+		var expected, actual strings.Builder
+		chanPrettyPrint(doc, width, &expected)
+		PrettyPrint(doc, width, &actual)
+		if expected.String() != actual.String() {
+			t.Errorf("width %d: expected %q, got %q", width,
+				expected.String(), actual.String())
+		}
+	}
+}
+
+func benchmarkPrinter(b *testing.B, width int,
+	print func(Element, int, io.Writer) error) {
+	doc := benchDocument()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		print(doc, width, io.Discard)
+	}
+}
+
+func BenchmarkPrettyPrintWide(b *testing.B) {
+	benchmarkPrinter(b, 180, PrettyPrint)
+}
+
+func BenchmarkPrettyPrintNarrow(b *testing.B) {
+	benchmarkPrinter(b, 4, PrettyPrint)
+}
+
+func BenchmarkChannelPipelineWide(b *testing.B) {
+	benchmarkPrinter(b, 180, chanPrettyPrint)
+}
+
+func BenchmarkChannelPipelineNarrow(b *testing.B) {
+	benchmarkPrinter(b, 4, chanPrettyPrint)
+}
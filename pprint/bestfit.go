@@ -0,0 +1,233 @@
+package pprint
+
+import (
+	"context"
+)
+
+// The best fit renderer follows Wadler's "A prettier printer" rather
+// than Kiselyov's algorithm.  Rather than measuring each group as a
+// whole, it lays the document out from the top, and when it comes to
+// a group it looks ahead to see whether the group and whatever
+// follows it fit on the rest of the line if the group is flat.  That
+// means it needs the whole document to hand and its lookahead isn't
+// bounded, but it can also try out the alternatives of a Choice, which
+// the streaming renderer can't.
+//
+// It only makes the layout decisions; everything else is done by
+// handing stream elements to the same printer as the streaming
+// renderer uses, so the two print the same way.
+
+type bestFit struct {
+	todo []command
+	// lookahead is the work stack for `fits`.
+	lookahead []command
+}
+
+// command is an entry on the best fit renderer's work stack.
+type command struct {
+	pending
+	// flat is true if `doc` is in a group which fits on the line.
+	flat bool
+}
+
+func (b *bestFit) push(doc Element, flat bool) {
+	b.todo = append(b.todo, command{pending{doc: doc}, flat})
+}
+
+func (b *bestFit) pushElt(kind eltKind) {
+	b.todo = append(b.todo, command{pending: pending{end: kind}})
+}
+
+func (b *bestFit) run(ctx context.Context, p *printer) error {
+	done := ctx.Done()
+	for len(b.todo) > 0 {
+		if done != nil {
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
+			}
+		}
+		top := b.todo[len(b.todo)-1]
+		b.todo = b.todo[:len(b.todo)-1]
+		if err := b.render(p, top); err != nil {
+			return err
+		}
+	}
+	return p.finish()
+}
+
+func (b *bestFit) render(p *printer, c command) error {
+	switch doc := c.doc.(type) {
+	case nil:
+		return p.print(streamElt{kind: c.end})
+	case *text:
+		return p.print(streamElt{kind: textKind, payload: doc.text})
+	case *cond:
+		b.push(doc.expansion, c.flat)
+	case *linebreak:
+		if doc.literal {
+			return p.print(streamElt{kind: litCRKind})
+		}
+		return p.print(streamElt{kind: crlfKind})
+	case *concat:
+		for i := len(doc.children) - 1; i >= 0; i-- {
+			b.push(doc.children[i], c.flat)
+		}
+	case *fill:
+		b.push(doc.expansion, c.flat)
+	case *group:
+		b.push(doc.child, c.flat || b.fits(p, doc.child, !doc.firstLine, doc.firstLine))
+	case *nest:
+		b.pushElt(nendKind)
+		b.push(doc.child, c.flat || b.fits(p, doc.child, true, false))
+		return p.print(streamElt{kind: nbegKind})
+	case *align:
+		b.pushElt(nendKind)
+		b.push(doc.child, c.flat)
+		return p.print(streamElt{kind: nbegKind, offset: doc.offset})
+	case *indent:
+		b.pushElt(nendKind)
+		b.push(doc.child, c.flat)
+		return p.print(streamElt{kind: ibegKind, offset: doc.offset})
+	case *prefix:
+		b.pushElt(pendKind)
+		b.push(doc.child, c.flat)
+		return p.print(streamElt{kind: pbegKind, payload: doc.prefix})
+	case *ifBreak:
+		if c.flat {
+			b.push(doc.flat, true)
+		} else {
+			if p.TrimTrailingSpace {
+				p.trimTrailing()
+			}
+			b.push(doc.broken, false)
+		}
+	case *choice:
+		last := len(doc.alternatives) - 1
+		chosen := last
+		if c.flat {
+			chosen = 0
+		} else {
+			for i, alt := range doc.alternatives[:last] {
+				if b.fits(p, alt, false, doc.firstFit) {
+					chosen = i
+					break
+				}
+			}
+		}
+		b.push(doc.alternatives[chosen], c.flat)
+	case *breakParent:
+	case *lineSuffix:
+		b.pushElt(suffixEndKind)
+		b.push(doc.child, true)
+		return p.print(streamElt{kind: suffixBegKind})
+	case *verbatim:
+		b.push(doc.expansion, c.flat)
+	case *dynamic:
+		if p.inSuffix > 0 {
+			// It's worked out when the line suffix is written.
+			return p.print(streamElt{kind: dynKind, value: doc})
+		}
+		b.push(doc.eval(p.hpos, p.Width, p.currentIndent().col), c.flat)
+	case *annotation:
+		b.pushElt(annEndKind)
+		b.push(doc.child, c.flat)
+		return p.print(streamElt{kind: annBegKind, value: doc.value})
+	case *mark:
+		b.pushElt(markEndKind)
+		b.push(doc.child, c.flat)
+		return p.print(streamElt{kind: markBegKind, value: doc.id})
+	default:
+		panic("Couldn't understand document type")
+	}
+	return nil
+}
+
+// fits reports whether `doc`, and then the rest of the document, fit
+// on what's left of the current line, up to the next line break.
+// Groups after `doc` are taken to be broken if the group they're in
+// is, and the first alternative of a Choice is used throughout.  A
+// hard line break in something flat means it doesn't fit at all.
+//
+// If `firstLine` is true, it's just `doc` that's measured instead, up
+// to its first hard line break, the same way as the streaming
+// renderer measures the alternatives of a FirstFit.  IfBreak and
+// groups in it are flat, so a hard line break in one of those still
+// means it doesn't fit.
+func (b *bestFit) fits(p *printer, doc Element, flat, firstLine bool) bool {
+	room := p.Width - p.hpos
+	if p.RibbonWidth > 0 {
+		if ribbon := p.RibbonWidth - (p.hpos - p.lineStart); ribbon < room {
+			room = ribbon
+		}
+	}
+	b.lookahead = append(b.lookahead[:0], command{pending{doc: doc}, flat})
+	rest := len(b.todo)
+	// used is how much of the line we've gone through so far.
+	used := 0
+	for room >= 0 {
+		if len(b.lookahead) == 0 {
+			if rest == 0 || firstLine {
+				return true
+			}
+			rest--
+			b.lookahead = append(b.lookahead, b.todo[rest])
+		}
+		c := b.lookahead[len(b.lookahead)-1]
+		b.lookahead = b.lookahead[:len(b.lookahead)-1]
+		switch doc := c.doc.(type) {
+		case *text:
+			w := p.Measure(doc.text)
+			room -= w
+			used += w
+		case *cond:
+			b.look(doc.expansion, c.flat)
+		case *linebreak:
+			return !c.flat
+		case *concat:
+			for i := len(doc.children) - 1; i >= 0; i-- {
+				b.look(doc.children[i], c.flat)
+			}
+		case *fill:
+			b.look(doc.expansion, c.flat)
+		case *group:
+			b.look(doc.child, c.flat || firstLine)
+		case *nest:
+			b.look(doc.child, c.flat || firstLine)
+		case *align:
+			b.look(doc.child, c.flat)
+		case *indent:
+			b.look(doc.child, c.flat)
+		case *prefix:
+			b.look(doc.child, c.flat)
+		case *annotation:
+			b.look(doc.child, c.flat)
+		case *mark:
+			b.look(doc.child, c.flat)
+		case *ifBreak:
+			if c.flat || firstLine {
+				b.look(doc.flat, c.flat)
+			} else {
+				b.look(doc.broken, false)
+			}
+		case *choice:
+			b.look(doc.alternatives[0], c.flat)
+		case *breakParent, *lineSuffix:
+			if c.flat {
+				return false
+			} else if firstLine {
+				return true
+			}
+		case *verbatim:
+			b.look(doc.expansion, c.flat)
+		case *dynamic:
+			b.look(doc.eval(p.hpos+used, p.Width, p.currentIndent().col), c.flat)
+		}
+	}
+	return false
+}
+
+func (b *bestFit) look(doc Element, flat bool) {
+	b.lookahead = append(b.lookahead, command{pending{doc: doc}, flat})
+}
@@ -0,0 +1,105 @@
+package pprint
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBestFitMatchesStreaming(t *testing.T) {
+	doc := benchDocument()
+
+	for _, width := range []int{4, 40, 80} {
+		expected, err := RenderOutput(doc, Options{Width: width})
+		if assert.NoError(t, err) {
+			out, err := RenderOutput(doc, Options{Width: width,
+				Algorithm: BestFit})
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, out)
+			}
+		}
+	}
+}
+
+func TestBestFitCountsFollowingText(t *testing.T) {
+	doc := benchDocument()
+
+	// The streaming renderer doesn't count the closing parenthesis
+	// after the arguments, so it goes one past the edge...
+	out, err := RenderOutput(doc, Options{Width: 50})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `expr(5).add(expr(7).frob())
+       .mul(expr(17), mul(expr(17)), mul(expr(17)))`, out)
+	}
+	// ...but best fit does.
+	out, err = RenderOutput(doc, Options{Width: 50, Algorithm: BestFit})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `expr(5).add(expr(7).frob())
+       .mul(expr(17),
+            mul(expr(17)),
+            mul(expr(17)))`, out)
+	}
+}
+
+func TestChoice(t *testing.T) {
+	body := Concat(Text("{"), Indent(2, Concat(LB, Text("return x"))),
+		LB, Text("}"))
+	lambda := Concat(Text("func(x int) "), body)
+	// Either the call hugs the lambda, or each argument gets a line
+	// of its own.
+	call := func(first string) Element {
+		return Concat(Text("apply("), Choice(
+			Concat(Text(first+", "), lambda, Text(")")),
+			Concat(Indent(4, Concat(LB, Text(first+","), LB, lambda)),
+				LB, Text(")"))))
+	}
+
+	short := call("xs")
+	out, err := RenderOutput(short, Options{Width: 30, Algorithm: BestFit})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "apply(xs, func(x int) {\n  return x\n})", out)
+	}
+	long := call("someLongerName")
+	out, err = RenderOutput(long, Options{Width: 30, Algorithm: BestFit})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `apply(
+    someLongerName,
+    func(x int) {
+      return x
+    }
+)`, out)
+	}
+
+	// The streaming renderer always picks the first alternative.
+	out, err = RenderOutput(long, Options{Width: 30})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "apply(someLongerName, func(x int) {\n  return x\n})", out)
+	}
+}
+
+func TestBestFitGroups(t *testing.T) {
+	handle := Group(Concat(Text("f("), CSV(Text("a"), Text("b"),
+		Concat(Text("c"), LineSuffix(Text(" // c")))), Text(")")))
+
+	out, err := RenderOutput(handle, Options{Width: 80, Algorithm: BestFit})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "f(a,\n  b,\n  c) // c", out)
+	}
+
+	handle = Concat(Text("x ="), Nest(Concat(Text(" "), Cond("", "", "\\"),
+		Text("long"))))
+	out, err = RenderOutput(handle, Options{Width: 6, Algorithm: BestFit,
+		TrimTrailingSpace: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x =\\\n   long", out)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = RenderContext(ctx, handle, &brokenWriter{}, Options{Width: 6,
+		Algorithm: BestFit})
+	assert.Equal(t, context.Canceled, err)
+	err = Render(handle, &brokenWriter{limit: 3}, Options{Width: 6,
+		Algorithm: BestFit})
+	assert.Equal(t, errBrokenWriter, err)
+}
@@ -1,5 +1,7 @@
 package pprint
 
+import "strings"
+
 var (
 	comma  = Text(",")
 	dot    = Text(".")
@@ -28,6 +30,24 @@ func CSV(elements ...Element) Element {
 	return Nest(Concat(elts...))
 }
 
+// FillCSV is like CSV, but only breaks lines where it has to, so as
+// to fit as many of `elements` on each line as possible.
+func FillCSV(elements ...Element) Element {
+	if len(elements) == 0 {
+		return Empty
+	}
+	elts := make([]Element, len(elements)*2-1)
+	for i, elt := range elements {
+		if i == len(elements)-1 {
+			elts[i*2] = elt
+		} else {
+			elts[i*2] = Concat(elt, comma)
+			elts[i*2+1] = CondLB
+		}
+	}
+	return Nest(Fill(elts...))
+}
+
 // Args formats `elements` in a manner suitable for C style
 // arguments.
 func Args(elements ...Element) Element {
@@ -70,3 +90,64 @@ func DottedList(elements ...Element) Element {
 func Funcall(name string, args ...Element) Element {
 	return Concat(Text(name), Args(args...))
 }
+
+// Words formats the whitespace separated words of `s` as a paragraph,
+// breaking lines between them only where needed.
+func Words(s string) Element {
+	return words(strings.Fields(s), CondLB)
+}
+
+func words(fields []string, separator Element) Element {
+	if len(fields) == 0 {
+		return Empty
+	}
+	elts := make([]Element, len(fields)*2-1)
+	for i, word := range fields {
+		if i > 0 {
+			elts[i*2-1] = separator
+		}
+		elts[i*2] = Text(word)
+	}
+	return Fill(elts...)
+}
+
+// Paragraph formats the prose in `s` like Words, except that a blank
+// line in `s` starts a new paragraph, and every line starts with
+// `prefix` (which may be empty); for instance with a prefix of "// "
+// it makes a comment.  Lines after the first line up with the first.
+func Paragraph(s, prefix string) Element {
+	var paragraphs [][]string
+	var current []string
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			current = append(current, fields...)
+		} else if len(current) > 0 {
+			paragraphs = append(paragraphs, current)
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, current)
+	}
+	if len(paragraphs) == 0 {
+		return Empty
+	}
+
+	separator := CondLB
+	if prefix != "" {
+		separator = Cond(" ", prefix, "")
+	}
+	blank := Concat(LB, Text(strings.TrimRight(prefix, " \t")), LB)
+	elts := make([]Element, 0, len(paragraphs)*4)
+	for i, paragraph := range paragraphs {
+		if i > 0 {
+			elts = append(elts, blank)
+		}
+		if prefix != "" {
+			elts = append(elts, Text(prefix))
+		}
+		elts = append(elts, words(paragraph, separator))
+	}
+	return Align(Concat(elts...))
+}
@@ -25,3 +25,25 @@ func TestDottedList(t *testing.T) {
 	assert.Equal(t, `Nest(Text("Foo"))`, DottedList(Text("Foo")).String())
 	assert.Equal(t, `Text("")`, DottedList().String())
 }
+
+func TestFillCSVDocument(t *testing.T) {
+	assert.Equal(t, `Nest(Fill(Text("Foo")Text(",")Cond(" ","","")Text("Bar")))`,
+		FillCSV(Text("Foo"), Text("Bar")).String())
+	assert.Equal(t, `Nest(Fill(Text("Foo")))`, FillCSV(Text("Foo")).String())
+	assert.Equal(t, `Text("")`, FillCSV().String())
+}
+
+func TestWords(t *testing.T) {
+	assert.Equal(t, `Fill(Text("Foo")Cond(" ","","")Text("Bar"))`,
+		Words("  Foo\n\tBar ").String())
+	assert.Equal(t, `Fill(Text("Foo"))`, Words("Foo").String())
+	assert.Equal(t, `Text("")`, Words(" ").String())
+}
+
+func TestParagraph(t *testing.T) {
+	assert.Equal(t, `Align(Fill(Text("Foo")Cond(" ","","")Text("Bar")))`,
+		Paragraph("Foo\nBar", "").String())
+	assert.Equal(t, `Align(Text("// ")Fill(Text("Foo"))CRText("//")CRText("// ")Fill(Text("Bar")))`,
+		Paragraph("Foo\n  \nBar", "// ").String())
+	assert.Equal(t, `Text("")`, Paragraph("\n\n", "// ").String())
+}
@@ -0,0 +1,169 @@
+package pprint
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// HTMLOptions controls how an HTMLSink marks up a document.
+type HTMLOptions struct {
+	// Tags gives the tags to put around text with the annotation
+	// `ann`, or two empty strings to leave it alone.  By default
+	// it's a span with `ann` as its class.
+	Tags func(ann interface{}) (open, close string)
+	// Pre wraps the document in a pre element.
+	Pre bool
+	// LineAnchors, if it isn't empty, puts each line in a span whose
+	// id is LineAnchors followed by the line number, counting from
+	// one, so that lines can be linked to; "L" gives "L1", "L2", and
+	// so on.
+	LineAnchors string
+}
+
+// spanTags puts annotated text in a span whose class is the
+// annotation.
+func spanTags(ann interface{}) (string, string) {
+	return `<span class="` + htmlEscaper.Replace(fmt.Sprint(ann)) + `">`, "</span>"
+}
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;",
+	`"`, "&#34;", "'", "&#39;")
+
+// An HTMLSink escapes text for HTML, and marks up the annotations it's
+// in.  Elements are always properly nested, even when an annotation
+// goes over several lines and each line has a span of its own.
+type HTMLSink struct {
+	w    io.Writer
+	opts HTMLOptions
+	// tags holds the tags for each open annotation.
+	tags [][2]string
+	// line is the current line number, and `lineOpen` is true once
+	// its span and the annotations it's in have been written.
+	line     int
+	lineOpen bool
+	started  bool
+	// LineEnding is written at the end of each line; "\n" if it's
+	// empty.
+	LineEnding string
+}
+
+// NewHTMLSink returns an HTMLSink which writes to `w`.
+func NewHTMLSink(w io.Writer, opts HTMLOptions) *HTMLSink {
+	if opts.Tags == nil {
+		opts.Tags = spanTags
+	}
+	return &HTMLSink{w: w, opts: opts, line: 1}
+}
+
+// RenderHTML is like Render, but writes `doc` as HTML.
+func RenderHTML(doc Element, out io.Writer, opts Options, html HTMLOptions) error {
+	h := NewHTMLSink(out, html)
+	h.LineEnding = opts.Newline
+	return RenderSink(doc, h, opts)
+}
+
+func (h *HTMLSink) WriteText(text string) error {
+	if err := h.openLine(""); err != nil {
+		return err
+	}
+	_, err := htmlEscaper.WriteString(h.w, text)
+	return err
+}
+
+func (h *HTMLSink) Newline(indent string) error {
+	if err := h.openLine(""); err != nil {
+		return err
+	}
+	if err := h.closeLine(); err != nil {
+		return err
+	}
+	if err := writeLineEnding(h.w, h.LineEnding); err != nil {
+		return err
+	}
+	h.line++
+	return h.openLine(indent)
+}
+
+// BeginAnnotation opens the tag for `ann`.
+func (h *HTMLSink) BeginAnnotation(ann interface{}) error {
+	if err := h.openLine(""); err != nil {
+		return err
+	}
+	open, close := h.opts.Tags(ann)
+	h.tags = append(h.tags, [2]string{open, close})
+	_, err := io.WriteString(h.w, open)
+	return err
+}
+
+// EndAnnotation closes the tag for `ann`.
+func (h *HTMLSink) EndAnnotation(ann interface{}) error {
+	close := h.tags[len(h.tags)-1][1]
+	h.tags = h.tags[:len(h.tags)-1]
+	_, err := io.WriteString(h.w, close)
+	return err
+}
+
+// Flush finishes off the last line and the document.
+func (h *HTMLSink) Flush() error {
+	if err := h.openLine(""); err != nil {
+		return err
+	}
+	if err := h.closeLine(); err != nil {
+		return err
+	}
+	if h.opts.Pre {
+		_, err := io.WriteString(h.w, "</pre>")
+		return err
+	}
+	return nil
+}
+
+// openLine starts the document and the current line, indented by
+// `indent`, if they haven't been already; if the line has a span of
+// its own, the annotations carried over from the last line are opened
+// again inside it, after the indentation.
+func (h *HTMLSink) openLine(indent string) error {
+	if h.lineOpen {
+		return nil
+	}
+	h.lineOpen = true
+	var b strings.Builder
+	if !h.started {
+		h.started = true
+		if h.opts.Pre {
+			b.WriteString("<pre>")
+		}
+	}
+	if h.opts.LineAnchors == "" {
+		b.WriteString(htmlEscaper.Replace(indent))
+	} else {
+		b.WriteString(`<span id="`)
+		b.WriteString(htmlEscaper.Replace(h.opts.LineAnchors))
+		b.WriteString(strconv.Itoa(h.line))
+		b.WriteString(`">`)
+		b.WriteString(htmlEscaper.Replace(indent))
+		for _, tags := range h.tags {
+			b.WriteString(tags[0])
+		}
+	}
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// closeLine closes the span for the current line, and the
+// annotations inside it, if there is one.
+func (h *HTMLSink) closeLine() error {
+	h.lineOpen = false
+	if h.opts.LineAnchors == "" {
+		return nil
+	}
+	var b strings.Builder
+	for i := len(h.tags) - 1; i >= 0; i-- {
+		b.WriteString(h.tags[i][1])
+	}
+	b.WriteString("</span>")
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
@@ -0,0 +1,53 @@
+package pprint
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHTMLSink(t *testing.T) {
+	handle := Concat(Annotate(KeywordToken, Text("if")), Text(" a < b {"),
+		Indent(2, Concat(LB, Annotate(CommentToken, Concat(Text("/* x &"),
+			LB, Text("y */"))))), LB, Text("}"))
+
+	buffer := new(bytes.Buffer)
+	err := RenderHTML(handle, buffer, Options{Width: 80}, HTMLOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `<span class="keyword">if</span> a &lt; b {
+  <span class="comment">/* x &amp;
+  y */</span>
+}`, buffer.String())
+	}
+
+	// With a span for each line, the comment has to be closed at
+	// the end of the line and opened again on the next.
+	buffer.Reset()
+	err = RenderHTML(handle, buffer, Options{Width: 80},
+		HTMLOptions{Pre: true, LineAnchors: "L"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `<pre><span id="L1"><span class="keyword">if</span> a &lt; b {</span>
+<span id="L2">  <span class="comment">/* x &amp;</span></span>
+<span id="L3">  <span class="comment">y */</span></span>
+<span id="L4">}</span></pre>`, buffer.String())
+	}
+}
+
+func TestHTMLTags(t *testing.T) {
+	handle := Concat(Annotate("b", Text("bold")), Text(" "),
+		Annotate("plain", Text(`"quoted"`)), LB)
+	tags := func(ann interface{}) (string, string) {
+		if ann == "b" {
+			return "<b>", "</b>"
+		}
+		return "", ""
+	}
+
+	buffer := new(bytes.Buffer)
+	err := RenderHTML(handle, buffer, Options{Width: 80},
+		HTMLOptions{Tags: tags, LineAnchors: "line-"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `<span id="line-1"><b>bold</b> &#34;quoted&#34;</span>
+<span id="line-2"></span>`, buffer.String())
+	}
+}
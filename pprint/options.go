@@ -0,0 +1,122 @@
+package pprint
+
+import (
+	"context"
+	"io"
+)
+
+// Options controls how Render lays out and writes a document.  The
+// zero value of each field other than Width picks a sensible default.
+type Options struct {
+	// Width is the right edge of the page.
+	Width int
+	// Measure works out how wide text is; MeasureCells by default.
+	Measure Measurer
+	// RibbonWidth, if positive, limits how many characters a group
+	// may put on a line not counting the indentation, so that deeply
+	// nested code isn't crammed against the right edge.
+	RibbonWidth int
+	// RibbonFraction sets RibbonWidth as a fraction of Width instead,
+	// as in Wadler's and Leijen's printers, if RibbonWidth isn't set
+	// and it's between 0 and 1.
+	RibbonFraction float64
+	// Newline is written for each line break by Render, RenderANSI
+	// and RenderHTML; "\n" by default.  Other sinks end lines their
+	// own way.
+	Newline string
+	// IndentChar is the character used for indentation; ' ' by
+	// default.  If it's '\t', indentation is written with as many
+	// tabs as possible and then spaces.
+	IndentChar rune
+	// SmartTabs indents with a tab for each level of Indent, and
+	// with spaces for alignment from Nest, Align and Hang, as gofmt
+	// does; the offset given to Indent only matters for its sign.
+	// IndentChar is ignored.
+	SmartTabs bool
+	// TabWidth is how many columns a tab counts for, whether it's
+	// used for indentation or appears in text; 8 by default.
+	TabWidth int
+	// TrimTrailingSpace removes spaces and tabs in text from the
+	// end of every line, for instance before the tail of a broken
+	// Cond, or if a Cond's small variant is a space and it ends up at
+	// the end of a line.  Indentation is never left at the end of a
+	// line either way.
+	TrimTrailingSpace bool
+	// Algorithm is how the layout is worked out; Streaming by
+	// default.
+	Algorithm Algorithm
+}
+
+// An Algorithm is a way of deciding where a document's line breaks go.
+type Algorithm int
+
+const (
+	// Streaming is Kiselyov's algorithm.  It prints as it goes,
+	// holding on to no more than about a line's worth of the
+	// document at a time, and is the fastest; but it only ever uses
+	// the first alternative of a Choice.
+	Streaming Algorithm = iota
+	// BestFit is Wadler's algorithm, which picks between the
+	// alternatives of a Choice by looking ahead to see which fits.
+	// It needs the whole document to be built before printing, and
+	// takes into account what follows a group on the line when
+	// deciding whether the group fits, so it can break lines in
+	// different places to Streaming.
+	BestFit
+)
+
+func (o Options) withDefaults() Options {
+	if o.Measure == nil {
+		o.Measure = MeasureCells
+	}
+	if o.Newline == "" {
+		o.Newline = "\n"
+	}
+	if o.IndentChar == 0 {
+		o.IndentChar = ' '
+	}
+	if o.RibbonWidth <= 0 && o.RibbonFraction > 0 && o.RibbonFraction < 1 {
+		o.RibbonWidth = int(o.RibbonFraction * float64(o.Width))
+		if o.RibbonWidth < 1 {
+			o.RibbonWidth = 1
+		}
+	}
+	if o.TabWidth <= 0 {
+		o.TabWidth = 8
+	}
+	if o.SmartTabs {
+		o.IndentChar = ' '
+	}
+	o.Measure = o.Measure.withTabs(o.TabWidth)
+	return o
+}
+
+// Render prints `doc` to `out` laid out according to `opts`.
+func Render(doc Element, out io.Writer, opts Options) error {
+	return RenderContext(context.Background(), doc, out, opts)
+}
+
+// RenderContext is like Render, but gives up with `ctx.Err()` if
+// `ctx` is cancelled before `doc` has been printed.
+func RenderContext(ctx context.Context, doc Element, out io.Writer, opts Options) error {
+	opts = opts.withDefaults()
+	p := newPipeline(doc, nil, opts)
+	defer p.release()
+	p.writeTo(out)
+	return p.run(ctx)
+}
+
+// RenderSink is like Render, but hands `doc` to `sink` instead of
+// writing it out.
+func RenderSink(doc Element, sink Sink, opts Options) error {
+	return RenderSinkContext(context.Background(), doc, sink, opts)
+}
+
+// RenderSinkContext is like RenderSink, but gives up with `ctx.Err()`
+// if `ctx` is cancelled before `doc` has been printed.
+func RenderSinkContext(ctx context.Context, doc Element, sink Sink, opts Options) error {
+	opts = opts.withDefaults()
+	p := newPipeline(doc, sink, opts)
+	defer p.release()
+	return p.run(ctx)
+}
@@ -0,0 +1,295 @@
+package pprint
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func RenderOutput(elt Element, opts Options) (string, error) {
+	buffer := new(bytes.Buffer)
+
+	err := Render(elt, buffer, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+func TestRenderMatchesPrettyPrint(t *testing.T) {
+	handle := DottedList(Funcall("expr", Text("5")),
+		Funcall("add", DottedList(Funcall("expr", Text("7")),
+			Funcall("frob"))),
+		Funcall("mul", DottedList(Funcall("expr", Text("17"))),
+			Funcall("mul", DottedList(Funcall("expr", Text("17")))),
+			Funcall("mul", DottedList(Funcall("expr", Text("17"))))))
+
+	for _, width := range []int{4, 50, 180} {
+		expected, err := Output(handle, width)
+		assert.NoError(t, err)
+		out, err := RenderOutput(handle, Options{Width: width})
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, out)
+		}
+	}
+}
+
+func TestNewline(t *testing.T) {
+	handle := Concat(Text("a"), LB, Text("b"), CondLB, Text("c"))
+
+	out, err := RenderOutput(handle, Options{Width: 80, Newline: "\r\n"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a\r\nb\r\nc", out)
+	}
+}
+
+func TestIndentChar(t *testing.T) {
+	handle := Concat(Text("0123456789"), CSV(Text("a"), Text("b")))
+
+	out, err := RenderOutput(handle, Options{Width: 4})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0123456789a,\n          b", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 4, IndentChar: '\t'})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0123456789a,\n\t  b", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 4, IndentChar: '\t',
+		TabWidth: 4})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0123456789a,\n\t\t  b", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 4, IndentChar: '.'})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0123456789a,\n..........b", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 4, IndentChar: '·'})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0123456789a,\n··········b", out)
+	}
+	long := Concat(Text("a"), Indent(70, Concat(LB, Text("b"))))
+	out, err = RenderOutput(long, Options{Width: 80, IndentChar: '·'})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a\n"+strings.Repeat("·", 70)+"b", out)
+	}
+}
+
+func TestTabsCountTowardsWidth(t *testing.T) {
+	handle := Concat(Text("abcd"),
+		Nest(Concat(LB, Group(Concat(Text("1234"), CondLB, Text("5"))))))
+
+	out, err := RenderOutput(handle, Options{Width: 10, IndentChar: '\t',
+		TabWidth: 4})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abcd\n\t1234 5", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 9, IndentChar: '\t',
+		TabWidth: 4})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abcd\n\t1234\n\t5", out)
+	}
+}
+
+func TestTrimTrailingSpace(t *testing.T) {
+	handle := Concat(Text("a"), Nest(Concat(Text("b "), LB, LB,
+		Text("c"), Cond(" ", " ", ""), Text("d  "))))
+
+	out, err := RenderOutput(handle, Options{Width: 80})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ab \n\n c\n  d  ", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 80,
+		TrimTrailingSpace: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ab\n\n c\n  d", out)
+	}
+}
+
+func TestRibbonWidth(t *testing.T) {
+	handle := Concat(Text("begin   "),
+		Nest(Concat(LB, Group(Concat(Text("aaaa"), CondLB, Text("bbbb"))))))
+
+	out, err := RenderOutput(handle, Options{Width: 20})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "begin   \n        aaaa bbbb", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 20, RibbonWidth: 9})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "begin   \n        aaaa bbbb", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 20, RibbonWidth: 8})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "begin   \n        aaaa\n        bbbb", out)
+	}
+}
+
+func TestRibbonNesting(t *testing.T) {
+	call := Group(Concat(Text("f("), CSV(Text("aaaa"), Text("bbbb"),
+		Text("cccc")), Text(")")))
+	// inline nests the call inside others on the same line, and
+	// block on lines of their own.
+	inline := func(depth int) Element {
+		doc := call
+		for i := 0; i < depth; i++ {
+			doc = Concat(Text("g("), Align(doc))
+		}
+		return doc
+	}
+	block := func(depth int) Element {
+		doc := call
+		for i := 0; i < depth; i++ {
+			doc = Concat(Text("{"), Indent(4, Concat(LB, doc)), LB,
+				Text("}"))
+		}
+		return doc
+	}
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		for _, c := range []struct {
+			opts  Options
+			doc   Element
+			depth int
+			flat  bool
+		}{
+			{Options{Width: 41}, inline(4), 4, true},
+			{Options{Width: 41}, inline(11), 11, true},
+			{Options{Width: 41}, inline(12), 12, false},
+			// With a ribbon, the more there is on the line
+			// before the call, the sooner it breaks...
+			{Options{Width: 41, RibbonWidth: 25}, inline(3), 3, true},
+			{Options{Width: 41, RibbonWidth: 25}, inline(4), 4, false},
+			{Options{Width: 41, RibbonFraction: 0.625}, inline(3), 3, true},
+			{Options{Width: 41, RibbonFraction: 0.625}, inline(4), 4, false},
+			{Options{Width: 41, RibbonWidth: 17}, inline(0), 0, false},
+			// ...but indentation doesn't count, so it's
+			// only the page which limits that.
+			{Options{Width: 41}, block(5), 5, true},
+			{Options{Width: 41}, block(6), 6, false},
+			{Options{Width: 41, RibbonWidth: 20}, block(5), 5, true},
+			{Options{Width: 41, RibbonWidth: 20}, block(6), 6, false},
+		} {
+			c.opts.Algorithm = algorithm
+			out, err := RenderOutput(c.doc, c.opts)
+			if assert.NoError(t, err) {
+				assert.Equal(t, c.flat,
+					strings.Contains(out, "f(aaaa, bbbb, cccc)"),
+					"depth %d: %q", c.depth, out)
+			}
+		}
+	}
+}
+
+func TestSmartTabs(t *testing.T) {
+	call := Group(Concat(Text("x := foo("), CSV(Text("a"), Text("b")),
+		Text(")")))
+	handle := Concat(Text("func f() {"),
+		Indent(4, Concat(LB, Text("if y {"), Indent(4, Concat(LB, call)),
+			LB, Text("}"))),
+		LB, Text("}"))
+
+	out, err := RenderOutput(handle, Options{Width: 80, SmartTabs: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "func f() {\n\tif y {\n\t\tx := foo(a, b)\n\t}\n}", out)
+	}
+	// The tabs count as eight columns each (the closing parenthesis
+	// isn't part of the group that breaks)...
+	out, err = RenderOutput(handle, Options{Width: 29, SmartTabs: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "func f() {\n\tif y {\n\t\tx := foo(a, b)\n\t}\n}", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 28, SmartTabs: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "func f() {\n\tif y {\n\t\tx := foo(a,\n\t\t         b)\n\t}\n}", out)
+	}
+	// ...or as many as we're told.
+	out, err = RenderOutput(handle, Options{Width: 17, SmartTabs: true,
+		TabWidth: 2})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "func f() {\n\tif y {\n\t\tx := foo(a, b)\n\t}\n}", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 16, SmartTabs: true,
+		TabWidth: 2})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "func f() {\n\tif y {\n\t\tx := foo(a,\n\t\t         b)\n\t}\n}", out)
+	}
+}
+
+func TestSmartTabsWithinAlignment(t *testing.T) {
+	handle := Concat(Text("var x = "), Align(Concat(Text("{"),
+		Indent(4, Concat(LB, Text("a"))), LB, Text("}"))))
+
+	out, err := RenderOutput(handle, Options{Width: 80, SmartTabs: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "var x = {\n\t        a\n        }", out)
+	}
+
+	handle = Indent(1, Concat(LB, Text("// "), Prefix("// ",
+		Concat(Text("a"), Indent(1, Concat(LB, Text("b")))))))
+	out, err = RenderOutput(handle, Options{Width: 80, SmartTabs: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "\n\t// a\n\t// \t   b", out)
+	}
+}
+
+func TestSmartTabsAfterPrefix(t *testing.T) {
+	handle := Concat(Text("// "), Prefix("// ", Concat(Text("if x {"),
+		Indent(1, Concat(LB, Group(Concat(Text("aaaa"), CondLB,
+			Text("bbbb"))))))))
+
+	// After the prefix, the tab only goes as far as the next tab
+	// stop, and spaces make up the rest of the indentation.
+	out, err := RenderOutput(handle, Options{Width: 20, SmartTabs: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "// if x {\n// \t   aaaa bbbb", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 19, SmartTabs: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "// if x {\n// \t   aaaa\n// \t   bbbb", out)
+	}
+
+	// The same goes for IndentChar.
+	handle = Concat(Text("// "), Prefix("// ", Concat(Text("x"),
+		Indent(9, Concat(LB, Text("y"))))))
+	out, err = RenderOutput(handle, Options{Width: 80, IndentChar: '\t'})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "// x\n// \t    y", out)
+	}
+}
+
+func TestTabsInText(t *testing.T) {
+	handle := Group(Concat(Text("a\tb"), CondLB, Text("c")))
+
+	out, err := RenderOutput(handle, Options{Width: 12})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a\tb c", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 11})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a\tb\nc", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 8, TabWidth: 4})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a\tb c", out)
+	}
+	out, err = RenderOutput(Group(Concat(Text("é\t"), CondLB, Text("c"))),
+		Options{Width: 11})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "é\t c", out)
+	}
+}
+
+func TestTrimBeforeTail(t *testing.T) {
+	handle := Concat(Text("x ="), Nest(Concat(Text(" "),
+		Cond("", "", "\\"), Text("long"))))
+
+	out, err := RenderOutput(handle, Options{Width: 6})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x = \\\n   long", out)
+	}
+	out, err = RenderOutput(handle, Options{Width: 6, TrimTrailingSpace: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x =\\\n   long", out)
+	}
+}
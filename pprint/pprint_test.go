@@ -2,7 +2,13 @@ package pprint
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -101,3 +107,703 @@ func TestInvolved(t *testing.T) {
             mul(expr(17)))`, out)
 	}
 }
+
+var errBrokenWriter = errors.New("broken writer")
+
+// brokenWriter fails every write after the first `limit` bytes.
+type brokenWriter struct {
+	limit int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errBrokenWriter
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestBrokenWriter(t *testing.T) {
+	handle := DottedList(Funcall("expr", Text("5")),
+		Funcall("add", DottedList(Funcall("expr", Text("7")),
+			Funcall("frob"))))
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		err := PrettyPrint(handle, 4, &brokenWriter{limit: 10})
+		assert.Equal(t, errBrokenWriter, err)
+	}
+	assert.Equal(t, before, runtime.NumGoroutine())
+}
+
+func TestCancelledContext(t *testing.T) {
+	handle := Group(Concat(Text("Some text"), CondLB,
+		Text("Some more text")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buffer := new(bytes.Buffer)
+	err := PrettyPrintContext(ctx, handle, 80, buffer)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, "", buffer.String())
+
+	err = PrettyPrintContext(context.Background(), handle, 80, buffer)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Some text Some more text", buffer.String())
+	}
+}
+
+func TestIndent(t *testing.T) {
+	handle := Concat(Text("func f() {"),
+		Indent(4, Concat(LB, Text("a()"), LB, Text("b()"))),
+		LB, Text("}"))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "func f() {\n    a()\n    b()\n}", out)
+	}
+
+	handle = Group(Concat(Text("call("),
+		Indent(4, Concat(Cond("", "", ""), CSV(Text("a"), Text("b")))),
+		Cond("", "", ""), Text(")")))
+
+	out, err = Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "call(a, b)", out)
+	}
+	out, err = Output(handle, 8)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "call(\n    a, b\n)", out)
+	}
+	out, err = Output(handle, 4)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "call(\n    a,\n    b\n)", out)
+	}
+}
+
+func TestIndentWithinNest(t *testing.T) {
+	block := Concat(Text("{"),
+		Indent(2, Concat(LB, Text("a"), LB, Indent(2, Concat(Text("b"), LB,
+			Text("c"))))),
+		LB, Text("}"))
+	handle := Concat(Text("x = "), Nest(block))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x = {\n      a\n      b\n        c\n    }", out)
+	}
+
+	handle = Concat(Text("{"), Indent(4, Concat(LB, Text("f("),
+		CSV(Text("a"), Text("b")), Text(")"))), LB, Text("}"))
+
+	out, err = Output(handle, 8)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\n    f(a,\n      b)\n}", out)
+	}
+}
+
+func TestAlign(t *testing.T) {
+	handle := Concat(Text("let x = "), Align(Concat(Text("1"), LB, Text("2"))))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "let x = 1\n        2", out)
+	}
+
+	// Unlike Nest, Align doesn't group, so the breaks are decided
+	// by the enclosing group.
+	handle = Group(Concat(Text("f "), Align(Concat(Text("a"), CondLB,
+		Group(Concat(Text("b"), CondLB, Text("c")))))))
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "f a b c"},
+		{6, "f a\n  b c"},
+		{2, "f a\n  b\n  c"},
+	} {
+		out, err = Output(handle, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+}
+
+func TestHang(t *testing.T) {
+	handle := Group(Concat(Text("- "), Hang(2, Concat(Text("item"), CondLB,
+		Text("continued"), CondLB, Text("again")))))
+
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "- item continued again"},
+		{20, "- item\n    continued\n    again"},
+	} {
+		out, err := Output(handle, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+
+	handle = Concat(Text("label: "), Hang(-7, Concat(Text("x"), LB,
+		Text("y"))))
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "label: x\ny", out)
+	}
+	handle = Concat(Text("ab"), Hang(-7, Concat(Text("x"), LB, Text("y"))))
+	out, err = Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abx\ny", out)
+	}
+}
+
+func TestOutdentedLabels(t *testing.T) {
+	stmt := func(s string) Element {
+		return Group(Concat(Text(s+"("), CSV(Text("a"), Text("b")), Text(")")))
+	}
+	label := func(s string) Element {
+		return Indent(-2, Concat(LB, Text(s)))
+	}
+	handle := Concat(Text("switch x {"),
+		Indent(4, Concat(label("case 1:"), LB, stmt("f"),
+			label("default:"), LB, stmt("g"))),
+		LB, Text("}"))
+
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "switch x {\n  case 1:\n    f(a, b)\n  default:\n    g(a, b)\n}"},
+		{8, "switch x {\n  case 1:\n    f(a,\n      b)\n  default:\n    g(a,\n      b)\n}"},
+	} {
+		out, err := Output(handle, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+}
+
+func TestIfBreak(t *testing.T) {
+	// A trailing comma and a closing brace on its own line, but only
+	// if the list is broken.
+	list := Group(Concat(Text("{"),
+		Indent(2, Concat(IfBreak(LB, Empty),
+			CSV(Text("alpha"), Text("beta")), IfBreak(Text(","), Empty))),
+		IfBreak(LB, Empty), Text("}")))
+
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "{alpha, beta}"},
+		{10, "{\n  alpha,\n  beta,\n}"},
+	} {
+		out, err := Output(list, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+
+	// Whole blocks as the alternatives.
+	body := Text("return x")
+	handle := Group(Concat(Text("if ok "),
+		IfBreak(Concat(Text("{"), Indent(4, Concat(LB, body)), LB, Text("}")),
+			Concat(Text("{ "), body, Text(" }")))))
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "if ok { return x }"},
+		{17, "if ok {\n    return x\n}"},
+	} {
+		out, err := Output(handle, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+
+	// Outside of any group it's always broken.
+	out, err := Output(IfBreak(Text("broken"), Text("flat")), 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "broken", out)
+	}
+}
+
+func TestNestedIfBreak(t *testing.T) {
+	inner := Group(Concat(Text("["), IfBreak(Text("..."),
+		Concat(Text("a"), IfBreak(Text("!"), Text(",")), Text("b"))), Text("]")))
+	handle := Group(Concat(Text("x"), IfBreak(Concat(Text(";"), LB),
+		Text(" ")), inner))
+
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "x [a,b]"},
+		{6, "x;\n[a,b]"},
+		{4, "x;\n[...]"},
+	} {
+		out, err := Output(handle, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+}
+
+func TestCondIsIfBreak(t *testing.T) {
+	cond := func(small, cont, tail string) Element {
+		return IfBreak(Concat(Text(tail), LB, Text(cont)), Text(small))
+	}
+	handle := DottedList(Funcall("expr", Text("5")),
+		Funcall("add", DottedList(Funcall("expr", Text("7")),
+			Funcall("frob"))),
+		Funcall("mul", DottedList(Funcall("expr", Text("17"))),
+			Funcall("mul", DottedList(Funcall("expr", Text("17")))),
+			Funcall("mul", DottedList(Funcall("expr", Text("17"))))))
+	expanded := Concat(Text("expr(5)"), Nest(Concat(Text(".add(expr(7).frob())"),
+		cond(".", ".", ""), Text("mul("),
+		Nest(Concat(Text("expr(17)"), Text(","), cond(" ", "", ""),
+			Text("mul(expr(17))"), Text(","), cond(" ", "", ""),
+			Text("mul(expr(17))"))),
+		Text(")"))))
+
+	for _, width := range []int{4, 50, 180} {
+		expected, err := Output(handle, width)
+		assert.NoError(t, err)
+		out, err := Output(expanded, width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, out)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	handle := Fill(Text("aaa"), CondLB, Text("bb"), CondLB, Text("cccc"),
+		CondLB, Text("d"))
+
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "aaa bb cccc d"},
+		{8, "aaa bb\ncccc d"},
+		{6, "aaa bb\ncccc d"},
+		{5, "aaa\nbb\ncccc\nd"},
+	} {
+		out, err := Output(handle, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+
+	// Trailing separators and degenerate fills.
+	out, err := Output(Fill(Text("a"), CondLB), 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a ", out)
+	}
+	out, err = Output(Fill(), 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", out)
+	}
+}
+
+func TestFillCSV(t *testing.T) {
+	bytes := make([]Element, 0, 10)
+	for _, b := range []string{"0x00", "0x01", "0x02", "0x03", "0x04",
+		"0x05", "0x06", "0x07", "0x08", "0x09"} {
+		bytes = append(bytes, Text(b))
+	}
+	handle := Concat(Text("data := []byte{"), FillCSV(bytes...), Text("}"))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "data := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}", out)
+	}
+	out, err = Output(handle, 40)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `data := []byte{0x00, 0x01, 0x02, 0x03,
+               0x04, 0x05, 0x06, 0x07,
+               0x08, 0x09}`, out)
+	}
+}
+
+func TestParagraphLayout(t *testing.T) {
+	prose := `The quick brown fox jumps over the lazy dog.
+It keeps on jumping.
+
+A second paragraph.`
+
+	out, err := Output(Paragraph(prose, ""), 24)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `The quick brown fox
+jumps over the lazy dog.
+It keeps on jumping.
+
+A second paragraph.`, out)
+	}
+
+	handle := Concat(Text("func f() {"), Indent(4, Concat(LB,
+		Paragraph(prose, "// "), LB, Text("return"))), LB, Text("}"))
+	out, err = Output(handle, 31)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `func f() {
+    // The quick brown fox
+    // jumps over the lazy dog.
+    // It keeps on jumping.
+    //
+    // A second paragraph.
+    return
+}`, out)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	handle := Concat(Text("// "), Prefix("// ", Fill(Text("aaa"), CondLB,
+		Text("bbb"), CondLB, Text("ccc"))))
+
+	for _, c := range []struct {
+		width int
+		out   string
+	}{
+		{80, "// aaa bbb ccc"},
+		{10, "// aaa bbb\n// ccc"},
+		{9, "// aaa\n// bbb\n// ccc"},
+	} {
+		out, err := Output(handle, c.width)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+}
+
+func TestNestedPrefix(t *testing.T) {
+	quoted := Concat(Text("> "), Prefix("> ", Concat(Text("hello"), LB,
+		Text("> "), Prefix("> ", Concat(Text("quoted"), LB,
+			Text("twice"))))))
+	handle := Concat(Text("{"), Indent(2, Concat(LB, quoted)), LB, Text("}"))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\n  > hello\n  > > quoted\n  > > twice\n}", out)
+	}
+
+	// Indentation inside the prefix goes after it.
+	handle = Concat(Text("# "), Prefix("# ", Concat(Text("if x:"),
+		Indent(4, Concat(LB, Text("y"))), LB, Text("z: "),
+		Align(Concat(Text("1"), LB, Text("2"))))))
+	out, err = Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "# if x:\n#     y\n# z: 1\n#    2", out)
+	}
+}
+
+func TestPrefixWidth(t *testing.T) {
+	args := Group(Concat(Text("f("), CSV(Text("aaaa"), Text("bbbb")),
+		Text(")")))
+	handle := Concat(Text("x"), Prefix("// ", Concat(LB, args)))
+
+	out, err := Output(handle, 15)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x\n// f(aaaa, bbbb)", out)
+	}
+	out, err = Output(handle, 14)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x\n// f(aaaa,\n//   bbbb)", out)
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	handle := Concat(Text("{"), Indent(2, Concat(LB, Text("a"), LB,
+		Nest(Concat(LB, Text("b"), LB, LB)), LB, Text("c"))), LB, Text("}"))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\n  a\n\n  b\n\n\n  c\n}", out)
+	}
+
+	handle = Indent(2, Concat(Text("x"), LB, Text("// "),
+		Prefix("// ", Concat(Text("a"), LB, LB, Text("b")))))
+	out, err = Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x\n  // a\n  //\n  // b", out)
+	}
+}
+
+func TestVerbatim(t *testing.T) {
+	sql := "SELECT *\n  FROM t\n\n  WHERE x"
+	handle := Concat(Text("query("), Nest(Concat(Verbatim(sql), Text(","),
+		CondLB, Text("args"))), Text(")"))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `query(SELECT *
+        FROM t
+
+        WHERE x,
+      args)`, out)
+	}
+	assert.Equal(t, 9, Verbatim(sql).Width())
+}
+
+func TestLiteral(t *testing.T) {
+	heredoc := "cat <<EOF\n  two\nEOF"
+	handle := Concat(Text("{"), Indent(2, Concat(LB, Literal(heredoc), LB,
+		Text("done"))), LB, Text("}"))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\n  cat <<EOF\n  two\nEOF\n  done\n}", out)
+	}
+
+	handle = Concat(Text("# "), Prefix("# ", Indent(2, Concat(Text("x"),
+		LB, Literal("a\n b")))))
+	out, err = Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "# x\n#   a\n#  b", out)
+	}
+}
+
+func TestBreakParent(t *testing.T) {
+	call := func(last Element) Element {
+		return Group(Concat(Text("f("), CSV(Text("a"), Text("b"), last),
+			Text(")")))
+	}
+
+	out, err := Output(call(Text("c")), 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "f(a, b, c)", out)
+	}
+	// A line break anywhere in the call breaks all of it...
+	out, err = Output(call(Verbatim("c\nd")), 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "f(a,\n  b,\n  c\n  d)", out)
+	}
+	out, err = Output(call(Concat(Text("c"), BreakParent)), 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "f(a,\n  b,\n  c)", out)
+	}
+	// ...but not groups inside it which it isn't in.
+	out, err = Output(call(Concat(Group(Concat(Text("[x"), CondLB,
+		Text("y]"))), LB, Text("z"))), 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "f(a,\n  b,\n  [x y]\n  z)", out)
+	}
+}
+
+func TestLineSuffix(t *testing.T) {
+	handle := Concat(Text("x"), LineSuffix(Text(" // x")), Text(";"))
+
+	out, err := Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "x; // x", out)
+	}
+
+	// The group has to break, however much room there is.
+	handle = Group(Concat(Text("f("), CSV(Concat(Text("a"),
+		LineSuffix(Concat(Text(" //"), CondLB, Text("first")))),
+		Text("b")), Text(")")))
+	out, err = Output(handle, 80)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "f(a, // first\n  b)", out)
+	}
+
+	// In a Fill, it's the separator after the commented content that
+	// breaks, not the one before.
+	commented := Concat(Text("bbbb"), LineSuffix(Text(" // b")))
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		for _, c := range []struct {
+			doc   Element
+			width int
+			out   string
+		}{
+			{Fill(Text("a"), CondLB, commented, CondLB, Text("c")), 80,
+				"a bbbb // b\nc"},
+			{Fill(Text("aaaa"), CondLB, commented, CondLB, Text("c")), 8,
+				"aaaa\nbbbb // b\nc"},
+			{Concat(Text("f("), FillCSV(Text("a"), commented, Text("c"),
+				Text("d")), Text(")")), 80, "f(a, bbbb, // b\n  c, d)"},
+		} {
+			out, err := RenderOutput(c.doc, Options{Width: c.width,
+				Algorithm: algorithm})
+			if assert.NoError(t, err) {
+				assert.Equal(t, c.out, out)
+			}
+		}
+	}
+}
+
+func TestFirstFit(t *testing.T) {
+	lambda := Concat(Text("func() {"), Indent(2, Concat(LB, Text("body"))),
+		LB, Text("}"))
+	call := func(last Element) Element {
+		return FirstFit(
+			Group(Concat(Text("f("), CSV(Text("a"), Text("b"), last),
+				Text(")"))),
+			Concat(Text("f(a, b, "), last, Text(")")),
+			Concat(Text("f("), Indent(2, Concat(LB, Text("a,"), LB,
+				Text("b,"), LB, last)), LB, Text(")")))
+	}
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		for _, c := range []struct {
+			last  Element
+			width int
+			out   string
+		}{
+			{Text("ccc"), 80, "f(a, b, ccc)"},
+			// The first alternative can't be flat, but the
+			// second's first line fits...
+			{lambda, 80, "f(a, b, func() {\n  body\n})"},
+			// ...until it doesn't.
+			{lambda, 15, "f(\n  a,\n  b,\n  func() {\n    body\n  }\n)"},
+			{Text("cccccccc"), 15, "f(\n  a,\n  b,\n  cccccccc\n)"},
+		} {
+			out, err := RenderOutput(call(c.last),
+				Options{Width: c.width, Algorithm: algorithm})
+			if assert.NoError(t, err) {
+				assert.Equal(t, c.out, out)
+			}
+		}
+
+		// The line break that ends the inner alternative's first
+		// line ends the outer one's too.
+		nested := FirstFit(FirstFit(Concat(Text("a("), LB, Text(")")),
+			Text("c")), Text("d"))
+		out, err := RenderOutput(nested, Options{Width: 80,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "a(\n)", out)
+		}
+
+		// A line suffix is flat, whatever's in it, and its end is
+		// the end of the first line.
+		suffix := FirstFit(Concat(Text("a"), LineSuffix(Group(Concat(
+			Text(" //"), LB, Text("x"))))), Text("d"))
+		out, err = RenderOutput(suffix, Options{Width: 80,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "a //x", out)
+		}
+	}
+}
+
+func TestWithColumn(t *testing.T) {
+	tab := WithColumn(func(col int) Element {
+		return Text(strings.Repeat(" ", 8-col%8))
+	})
+	column := WithColumn(func(col int) Element {
+		return Text(strconv.Itoa(col))
+	})
+	handle := Concat(Text("ab"), tab, Text("x"), tab, Text("y"),
+		Group(Concat(Text(" aaaa"), CondLB, column)))
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		out, err := RenderOutput(handle, Options{Width: 80,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "ab      x       y aaaa 23", out)
+		}
+		out, err = RenderOutput(handle, Options{Width: 22,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "ab      x       y aaaa\n0", out)
+		}
+		// In a line suffix, it's the column the suffix ends up at.
+		suffix := Concat(Text("a"), LineSuffix(Concat(Text(" @"), column)),
+			Text("bcd"), LB, Text("e"))
+		out, err = RenderOutput(suffix, Options{Width: 80,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "abcd @6\ne", out)
+		}
+	}
+}
+
+func TestWithPageWidth(t *testing.T) {
+	handle := Concat(Text("x := "), WithPageWidth(func(width int) Element {
+		if width < 20 {
+			return Text("f()")
+		}
+		return Text("function()")
+	}))
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		out, err := RenderOutput(handle, Options{Width: 20,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "x := function()", out)
+		}
+		out, err = RenderOutput(handle, Options{Width: 19,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "x := f()", out)
+		}
+	}
+}
+
+func TestWithIndent(t *testing.T) {
+	depth := WithIndent(func(indent int) Element {
+		return Text(strconv.Itoa(indent))
+	})
+	handle := Concat(depth, Indent(4, Concat(LB, depth, Text(" "),
+		Align(Concat(LB, depth)))))
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		out, err := RenderOutput(handle, Options{Width: 80,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "0\n    4 \n      6", out)
+		}
+	}
+}
+
+// tagSink writes annotations as tags around the text in them.
+type tagSink struct {
+	*TextSink
+	buffer *bytes.Buffer
+}
+
+func newTagSink() *tagSink {
+	buffer := new(bytes.Buffer)
+	return &tagSink{NewTextSink(buffer), buffer}
+}
+
+func (s *tagSink) BeginAnnotation(ann interface{}) error {
+	_, err := fmt.Fprintf(s.buffer, "<%v>", ann)
+	return err
+}
+
+func (s *tagSink) EndAnnotation(ann interface{}) error {
+	_, err := fmt.Fprintf(s.buffer, "</%v>", ann)
+	return err
+}
+
+func TestAnnotate(t *testing.T) {
+	keyword := func(s string) Element { return Annotate(KeywordToken, Text(s)) }
+	handle := Concat(keyword("if"), Text(" x {"), Indent(2, Concat(LB,
+		Annotate("call", Concat(Text("f("), CSV(Annotate(NumberToken, Text("1")),
+			Annotate(StringToken, Text(`"a"`))), Text(")"))),
+		LineSuffix(Annotate(CommentToken, Text(" // f"))),
+		LB, Annotate("empty", Empty))), LB, Text("}"))
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		out := newTagSink()
+		err := RenderSink(handle, out, Options{Width: 80, Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, `<keyword>if</keyword> x {
+  <call>f(<number>1</number>, <string>"a"</string>)</call><comment> // f</comment>
+
+}`, out.buffer.String())
+		}
+		// Annotations make no difference to plain writers.
+		plain, err := RenderOutput(handle, Options{Width: 80,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "if x {\n  f(1, \"a\") // f\n\n}", plain)
+		}
+	}
+}
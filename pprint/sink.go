@@ -0,0 +1,75 @@
+package pprint
+
+import (
+	"io"
+)
+
+// A Sink is where a rendered document goes.  The renderer drives it a
+// line at a time: the text on the first line, then for each line after
+// that a call to Newline and the text on it, so a Sink needn't look at
+// the text to tell where lines start and end.  The indentation of
+// blank lines is never written, but whitespace at the end of text is
+// only dropped with Options.TrimTrailingSpace.  Any error a Sink
+// returns stops the rendering.
+type Sink interface {
+	// WriteText writes `text` on the current line.  It has no line
+	// breaks in it unless the document's Text or Verbatim did.
+	WriteText(text string) error
+	// Newline ends the current line, and starts the next one with
+	// `indent`, the whitespace in front of its first text.
+	Newline(indent string) error
+	// BeginAnnotation and EndAnnotation say where the text marked
+	// with an annotation by Annotate starts and ends.  Annotations
+	// are always properly nested, and may go on over several lines.
+	BeginAnnotation(ann interface{}) error
+	EndAnnotation(ann interface{}) error
+	// Flush is called once the whole document has been handed over.
+	Flush() error
+}
+
+// A TextSink writes a document as plain text to an io.Writer, ignoring
+// annotations.  It's what Render uses.
+type TextSink struct {
+	w io.Writer
+	// LineEnding is written at the end of each line; "\n" if it's
+	// empty.
+	LineEnding string
+}
+
+// NewTextSink returns a TextSink which writes to `w`.
+func NewTextSink(w io.Writer) *TextSink {
+	return &TextSink{w: w}
+}
+
+func (s *TextSink) WriteText(text string) error {
+	_, err := io.WriteString(s.w, text)
+	return err
+}
+
+func (s *TextSink) Newline(indent string) error {
+	if err := writeLineEnding(s.w, s.LineEnding); err != nil {
+		return err
+	}
+	return s.WriteText(indent)
+}
+
+func (s *TextSink) BeginAnnotation(ann interface{}) error {
+	return nil
+}
+
+func (s *TextSink) EndAnnotation(ann interface{}) error {
+	return nil
+}
+
+func (s *TextSink) Flush() error {
+	return nil
+}
+
+// writeLineEnding writes `ending`, or "\n" if it's empty.
+func writeLineEnding(w io.Writer, ending string) error {
+	if ending == "" {
+		ending = "\n"
+	}
+	_, err := io.WriteString(w, ending)
+	return err
+}
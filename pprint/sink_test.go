@@ -0,0 +1,83 @@
+package pprint
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// recordingSink keeps a log of what it's told to do.
+type recordingSink struct {
+	calls []string
+	// failOn is a call to fail at, if it isn't empty.
+	failOn string
+}
+
+var errRecordingSink = errors.New("recording sink failed")
+
+func (s *recordingSink) record(call string) error {
+	s.calls = append(s.calls, call)
+	if call == s.failOn {
+		return errRecordingSink
+	}
+	return nil
+}
+
+func (s *recordingSink) WriteText(text string) error {
+	return s.record(fmt.Sprintf("text %q", text))
+}
+
+func (s *recordingSink) Newline(indent string) error {
+	return s.record(fmt.Sprintf("newline %q", indent))
+}
+
+func (s *recordingSink) BeginAnnotation(ann interface{}) error {
+	return s.record(fmt.Sprintf("begin %v", ann))
+}
+
+func (s *recordingSink) EndAnnotation(ann interface{}) error {
+	return s.record(fmt.Sprintf("end %v", ann))
+}
+
+func (s *recordingSink) Flush() error {
+	return s.record("flush")
+}
+
+func TestRenderSink(t *testing.T) {
+	handle := Concat(Text("a"), Indent(2, Concat(LB, Text("b "), LB, LB,
+		Annotate(KeywordToken, Text("c")))), LB)
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		sink := new(recordingSink)
+		err := RenderSink(handle, sink, Options{Width: 80,
+			Algorithm: algorithm, TrimTrailingSpace: true})
+		if assert.NoError(t, err) {
+			// The indentation comes with the line break, and the
+			// blank line has none.
+			assert.Equal(t, []string{`text "a"`, `newline "  "`,
+				`text "b"`, `newline ""`, `newline "  "`,
+				`begin keyword`, `text "c"`, `end keyword`,
+				`newline ""`, `flush`}, sink.calls)
+		}
+	}
+
+	sink := &recordingSink{failOn: `newline ""`}
+	err := RenderSink(handle, sink, Options{Width: 80})
+	assert.Equal(t, errRecordingSink, err)
+	assert.Equal(t, []string{`text "a"`, `newline "  "`, `text "b "`,
+		`newline ""`}, sink.calls)
+}
+
+func TestTextSink(t *testing.T) {
+	handle := Concat(Text("a"), Nest(Concat(Text("("), LB, Text("b"))), LB)
+
+	buffer := new(bytes.Buffer)
+	sink := NewTextSink(buffer)
+	sink.LineEnding = "\r\n"
+	err := RenderSink(handle, sink, Options{Width: 80})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a(\r\n b\r\n", buffer.String())
+	}
+}
@@ -0,0 +1,203 @@
+package pprint
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// A Position is a place in rendered output.  Line and Column count
+// from zero, as in source maps, and Column and Offset are in bytes;
+// Offset counts each line break as Options.Newline.
+type Position struct {
+	Line, Column, Offset int
+}
+
+// A MarkSpan is where the element in a Mark ended up in the output,
+// from the start of its first text to the end of its last.
+type MarkSpan struct {
+	ID         interface{}
+	Start, End Position
+}
+
+// A Result describes what was rendered.
+type Result struct {
+	// Marks holds where each Mark in the document ended up, in the
+	// order they start in the output.
+	Marks []MarkSpan
+}
+
+// RenderMarks is like Render, but also reports where each Mark ended
+// up.
+func RenderMarks(doc Element, out io.Writer, opts Options) (*Result, error) {
+	return RenderMarksContext(context.Background(), doc, out, opts)
+}
+
+// RenderMarksContext is like RenderMarks, but gives up with
+// `ctx.Err()` if `ctx` is cancelled before `doc` has been printed.
+func RenderMarksContext(ctx context.Context, doc Element, out io.Writer, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	p := newPipeline(doc, nil, opts)
+	defer p.release()
+	p.writeTo(out)
+	if err := p.run(ctx); err != nil {
+		return nil, err
+	}
+	return &Result{Marks: append([]MarkSpan(nil), p.printer.marks...)}, nil
+}
+
+// A SourceLocation is a place in a source file.  Marks whose ids are
+// SourceLocations are what go into a source map.
+type SourceLocation struct {
+	// Source is the name of the source file.
+	Source string
+	// Line and Column count from zero.
+	Line, Column int
+	// Name is the original name of the symbol there, if it has one.
+	Name string
+}
+
+// sourceMap is the JSON form of a Source Map v3.
+type sourceMap struct {
+	Version  int      `json:"version"`
+	File     string   `json:"file,omitempty"`
+	Sources  []string `json:"sources"`
+	Names    []string `json:"names"`
+	Mappings string   `json:"mappings"`
+}
+
+// segment is a mapping from a place in the output onwards to `loc`, or
+// to nothing if `loc` is nil.
+type segment struct {
+	at  Position
+	loc *SourceLocation
+}
+
+// SourceMap encodes where the marks whose ids are SourceLocations
+// ended up as a Source Map v3 for the generated file `file`.  The
+// output from the start of each of those marks maps to its location,
+// up to its end or the next of them inside it; since mappings don't
+// carry over from one line to the next, each line it goes on to maps
+// to it again from the start.  Output that isn't in any of them is
+// left unmapped.  Columns in the output are counted in bytes, like
+// those in Position, so they only match what JavaScript tools expect
+// if the output is ASCII.
+func (r *Result) SourceMap(file string) ([]byte, error) {
+	m := sourceMap{Version: 3, File: file, Sources: []string{}, Names: []string{}}
+	sources := map[string]int{}
+	names := map[string]int{}
+	index := func(table map[string]int, list *[]string, s string) int {
+		i, ok := table[s]
+		if !ok {
+			i = len(*list)
+			table[s] = i
+			*list = append(*list, s)
+		}
+		return i
+	}
+
+	var b strings.Builder
+	// Everything but the output column is relative to the segment
+	// before, even on an earlier line.
+	line, column, source, sourceLine, sourceColumn, name := 0, 0, 0, 0, 0, 0
+	for i, s := range r.segments() {
+		if s.at.Line > line {
+			b.WriteString(strings.Repeat(";", s.at.Line-line))
+			line, column = s.at.Line, 0
+		} else if i > 0 {
+			b.WriteByte(',')
+		}
+		writeVLQ(&b, s.at.Column-column)
+		column = s.at.Column
+		if s.loc == nil {
+			continue
+		}
+		n := index(sources, &m.Sources, s.loc.Source)
+		writeVLQ(&b, n-source)
+		writeVLQ(&b, s.loc.Line-sourceLine)
+		writeVLQ(&b, s.loc.Column-sourceColumn)
+		source, sourceLine, sourceColumn = n, s.loc.Line, s.loc.Column
+		if s.loc.Name != "" {
+			n = index(names, &m.Names, s.loc.Name)
+			writeVLQ(&b, n-name)
+			name = n
+		}
+	}
+	m.Mappings = b.String()
+	return json.Marshal(m)
+}
+
+// segments works out where the mapping changes in the output, and
+// where it has to be given again at the start of a line.  Marks nest,
+// so as each one ends the mapping goes back to the one around it.
+func (r *Result) segments() []segment {
+	var segments []segment
+	add := func(at Position, loc *SourceLocation) {
+		if n := len(segments); n > 0 {
+			// The mapping so far starts over on each new line up to
+			// here.
+			if last := segments[n-1]; last.loc != nil {
+				for line := last.at.Line + 1; line <= at.Line; line++ {
+					segments = append(segments, segment{Position{Line: line}, last.loc})
+				}
+			}
+			// A later segment in the same place replaces the earlier.
+			last := &segments[len(segments)-1]
+			if last.at.Line == at.Line && last.at.Column == at.Column {
+				last.loc = loc
+				return
+			}
+		}
+		segments = append(segments, segment{at, loc})
+	}
+
+	var open []MarkSpan
+	closeTo := func(offset int) {
+		for len(open) > 0 && open[len(open)-1].End.Offset <= offset {
+			end := open[len(open)-1].End
+			open = open[:len(open)-1]
+			var loc *SourceLocation
+			if len(open) > 0 {
+				outer := open[len(open)-1].ID.(SourceLocation)
+				loc = &outer
+			}
+			add(end, loc)
+		}
+	}
+	for _, m := range r.Marks {
+		loc, ok := m.ID.(SourceLocation)
+		if !ok || m.Start.Offset == m.End.Offset {
+			continue
+		}
+		closeTo(m.Start.Offset)
+		add(m.Start, &loc)
+		open = append(open, m)
+	}
+	if len(open) > 0 {
+		closeTo(open[0].End.Offset)
+	}
+	return segments
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// writeVLQ writes `n` as a base 64 variable length quantity, with the
+// sign in the lowest bit.
+func writeVLQ(b *strings.Builder, n int) {
+	v := n << 1
+	if n < 0 {
+		v = -n<<1 | 1
+	}
+	for {
+		digit := v & 31
+		v >>= 5
+		if v > 0 {
+			digit |= 32
+		}
+		b.WriteByte(base64Digits[digit])
+		if v == 0 {
+			return
+		}
+	}
+}
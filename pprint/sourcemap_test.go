@@ -0,0 +1,102 @@
+package pprint
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRenderMarks(t *testing.T) {
+	handle := Concat(Mark("f", Concat(Text("func f() {"),
+		Indent(2, Concat(LB, Mark("ret", Concat(Text("return "),
+			Mark("call", Text("g(x)")))))), LB, Text("}"))), LB)
+
+	for _, algorithm := range []Algorithm{Streaming, BestFit} {
+		buffer := new(bytes.Buffer)
+		result, err := RenderMarks(handle, buffer, Options{Width: 80,
+			Algorithm: algorithm})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "func f() {\n  return g(x)\n}\n", buffer.String())
+			assert.Equal(t, []MarkSpan{
+				{"f", Position{0, 0, 0}, Position{2, 1, 26}},
+				// The indentation isn't part of the mark.
+				{"ret", Position{1, 2, 13}, Position{1, 13, 24}},
+				{"call", Position{1, 9, 20}, Position{1, 13, 24}},
+			}, result.Marks)
+		}
+	}
+
+	// Offsets count the whole of each line break, and a mark with
+	// nothing in it is where the text would have been.
+	handle = Concat(Text("a"), Indent(2, Concat(LB, Mark("b", Text("b")),
+		Mark("empty", Empty))))
+	result, err := RenderMarks(handle, new(bytes.Buffer), Options{Width: 80,
+		Newline: "\r\n"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []MarkSpan{
+			{"b", Position{1, 2, 5}, Position{1, 3, 6}},
+			{"empty", Position{1, 3, 6}, Position{1, 3, 6}},
+		}, result.Marks)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = RenderMarksContext(ctx, handle, new(bytes.Buffer),
+		Options{Width: 80})
+	assert.Nil(t, result)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSourceMap(t *testing.T) {
+	main := SourceLocation{Source: "a.src", Name: "main"}
+	one := SourceLocation{Source: "a.src", Line: 1, Column: 4}
+	y := SourceLocation{Source: "b.src", Line: 2}
+	handle := Mark(main, Concat(Text("x = "), Mark(one, Text("1")), Text(";"),
+		LB, Mark(y, Text("y"))))
+
+	result, err := RenderMarks(handle, new(bytes.Buffer), Options{Width: 80})
+	if assert.NoError(t, err) {
+		m, err := result.SourceMap("out.js")
+		if assert.NoError(t, err) {
+			// After "1" the mapping goes back to main, and after "y"
+			// nothing's mapped at all.
+			assert.Equal(t, `{"version":3,"file":"out.js",`+
+				`"sources":["a.src","b.src"],"names":["main"],`+
+				`"mappings":"AAAAA,IACI,CADJA;ACEA,C"}`, string(m))
+		}
+	}
+
+	// A mark over several lines is mapped again at the start of each.
+	result, err = RenderMarks(Mark(main, Concat(Text("aa"), LB, Text("bb"),
+		LB, Text("cc"))), new(bytes.Buffer), Options{Width: 80})
+	if assert.NoError(t, err) {
+		m, err := result.SourceMap("out.js")
+		if assert.NoError(t, err) {
+			assert.Equal(t, `{"version":3,"file":"out.js",`+
+				`"sources":["a.src"],"names":["main"],`+
+				`"mappings":"AAAAA;AAAAA;AAAAA,E"}`, string(m))
+		}
+	}
+
+	// Marks with other ids are left out.
+	result, err = RenderMarks(Mark("x", Text("x")), new(bytes.Buffer),
+		Options{Width: 80})
+	if assert.NoError(t, err) {
+		m, err := result.SourceMap("")
+		if assert.NoError(t, err) {
+			assert.Equal(t, `{"version":3,"sources":[],"names":[],"mappings":""}`,
+				string(m))
+		}
+	}
+}
+
+func TestVLQ(t *testing.T) {
+	for n, expected := range map[int]string{0: "A", 1: "C", -1: "D",
+		15: "e", 16: "gB", -16: "hB", 1000: "w+B"} {
+		var b strings.Builder
+		writeVLQ(&b, n)
+		assert.Equal(t, expected, b.String(), "%d", n)
+	}
+}
@@ -7,69 +7,142 @@ import (
 // While the document types are handy for creating a layout, they're
 // not that useful for actually pretty printing the document.  For
 // that, we use these stream types.
+//
+// Elements which pick between alternative documents, like IfBreak,
+// put every alternative in the stream one after the other: ABeg, the
+// first alternative, ANext, the second, and so on up to AEnd.  The
+// printer then skips all but the one it chooses.  Positions are
+// counted as if only the first alternative were there, which is the
+// one used to decide whether enclosing groups fit; each later
+// alternative is counted from the position of the ABeg, as if it had
+// replaced the first.
+//
+// Stream elements are small values rather than pointers to a family
+// of types; the renderer copies them between stages and keeps them in
+// a single lookahead buffer, so this way printing a document doesn't
+// allocate once per element.
+
+type eltKind uint8
+
+const (
+	textKind eltKind = iota
+	crlfKind
+	nbegKind
+	nendKind
+	gbegKind
+	gendKind
+	ibegKind
+	altBegKind
+	altNextKind
+	altEndKind
+	pbegKind
+	pendKind
+	litCRKind
+	breakKind
+	suffixBegKind
+	suffixEndKind
+	mbegKind
+	mendKind
+	dynKind
+	annBegKind
+	annEndKind
+	markBegKind
+	markEndKind
+)
 
-type streamElt interface {
-	String() string
-}
-
-type elt struct {
+type streamElt struct {
+	kind eltKind
+	// hpos is the horizontal position of the last character of the
+	// element, or -1 if it isn't known yet.
 	hpos int
-}
-
-type textElt struct {
-	elt
+	// payload is the text of a Text element, or the prefix for a
+	// PBeg.
 	payload string
-}
-
-func (e *textElt) String() string {
-	return fmt.Sprintf(`TE(%d,"%s")`, e.hpos, e.payload)
-}
-
-type condElt struct {
-	elt
-	small, cont, tail string
-}
-
-func (e *condElt) String() string {
-	return fmt.Sprintf(`CE(%d,"%s","%s","%s")`, e.hpos, e.small, e.cont, e.tail)
-}
-
-type crlfElt struct {
-	elt
-}
-
-func (e *crlfElt) String() string {
-	return fmt.Sprintf(`CR(%d)`, e.hpos)
-}
-
-type nbegElt struct {
-	elt
-}
-
-func (e *nbegElt) String() string {
-	return fmt.Sprintf(`NBeg(%d)`, e.hpos)
-}
-
-type nendElt struct {
-	elt
-}
-
-func (e *nendElt) String() string {
-	return fmt.Sprintf(`NEnd(%d)`, e.hpos)
-}
-
-type gbegElt struct {
-	elt
-}
-
-func (e *gbegElt) String() string {
-	return fmt.Sprintf(`GBeg(%d)`, e.hpos)
-}
-
-type gendElt struct {
-	elt
-}
+	// offset is the extra indentation for an NBeg or IBeg, how to
+	// choose between the alternatives after an ABeg, or for a GBeg,
+	// measureFirstLine if the group is measured like an MBeg.
+	offset int
+	// value is the element a Dyn stands for, which is only evaluated
+	// for real by the printer, the annotation for an Ann, or the id
+	// for a Mark.
+	value interface{}
+}
+
+// measureFirstLine marks a GBeg whose group is only measured up to its
+// first hard line break, like an MBeg, although the printer treats it
+// as any other group.
+const measureFirstLine = 1
+
+// The ways the printer can choose between alternatives.
+const (
+	// chooseIfBreak picks the first alternative if the enclosing
+	// group fits, and the second if it doesn't.
+	chooseIfBreak = iota
+	// chooseFirst always picks the first alternative.
+	chooseFirst
+	// chooseFits picks the first alternative which fits, judging by
+	// the MBeg at its start, or the last if none of them do.
+	chooseFits
+)
 
-func (e *gendElt) String() string {
-	return fmt.Sprintf(`GEnd(%d)`, e.hpos)
+func (e streamElt) String() string {
+	switch e.kind {
+	case textKind:
+		return fmt.Sprintf(`TE(%d,"%s")`, e.hpos, e.payload)
+	case crlfKind:
+		return fmt.Sprintf(`CR(%d)`, e.hpos)
+	case litCRKind:
+		return fmt.Sprintf(`LitCR(%d)`, e.hpos)
+	case suffixBegKind:
+		return fmt.Sprintf(`SBeg(%d)`, e.hpos)
+	case suffixEndKind:
+		return fmt.Sprintf(`SEnd(%d)`, e.hpos)
+	case breakKind:
+		return fmt.Sprintf(`Break(%d)`, e.hpos)
+	case nbegKind:
+		if e.offset != 0 {
+			return fmt.Sprintf(`NBeg(%d,%d)`, e.hpos, e.offset)
+		}
+		return fmt.Sprintf(`NBeg(%d)`, e.hpos)
+	case nendKind:
+		return fmt.Sprintf(`NEnd(%d)`, e.hpos)
+	case gbegKind:
+		if e.offset != 0 {
+			return fmt.Sprintf(`GBeg(%d,%d)`, e.hpos, e.offset)
+		}
+		return fmt.Sprintf(`GBeg(%d)`, e.hpos)
+	case gendKind:
+		return fmt.Sprintf(`GEnd(%d)`, e.hpos)
+	case dynKind:
+		return fmt.Sprintf(`Dyn(%d)`, e.hpos)
+	case annBegKind:
+		return fmt.Sprintf(`Ann(%d,%v)`, e.hpos, e.value)
+	case annEndKind:
+		return fmt.Sprintf(`AnnEnd(%d)`, e.hpos)
+	case markBegKind:
+		return fmt.Sprintf(`Mark(%d,%v)`, e.hpos, e.value)
+	case markEndKind:
+		return fmt.Sprintf(`MarkEnd(%d)`, e.hpos)
+	case mbegKind:
+		return fmt.Sprintf(`MBeg(%d)`, e.hpos)
+	case mendKind:
+		return fmt.Sprintf(`MEnd(%d)`, e.hpos)
+	case ibegKind:
+		return fmt.Sprintf(`IBeg(%d,%d)`, e.hpos, e.offset)
+	case pbegKind:
+		return fmt.Sprintf(`PBeg(%d,"%s")`, e.hpos, e.payload)
+	case pendKind:
+		return fmt.Sprintf(`PEnd(%d)`, e.hpos)
+	case altBegKind:
+		if e.offset != chooseIfBreak {
+			return fmt.Sprintf(`ABeg(%d,%d)`, e.hpos, e.offset)
+		}
+		return fmt.Sprintf(`ABeg(%d)`, e.hpos)
+	case altNextKind:
+		return fmt.Sprintf(`ANext(%d)`, e.hpos)
+	case altEndKind:
+		return fmt.Sprintf(`AEnd(%d)`, e.hpos)
+	default:
+		return fmt.Sprintf(`?(%d)`, e.hpos)
+	}
 }
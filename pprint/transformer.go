@@ -1,265 +1,1201 @@
 package pprint
 
 import (
+	"context"
 	"io"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
-// toStream recursively converts a document into the stream elements
-// we'll be using.  We use channels to organize the coroutines.
-func toStream(document Element) <-chan streamElt {
-	ch := make(chan streamElt)
-	go func() {
-		defer close(ch)
-		visitElement(document, ch)
-	}()
-	return ch
-}
-
-func visitElement(document Element, out chan<- streamElt) {
-	switch doc := document.(type) {
-	case *text:
-		out <- &textElt{elt{-1}, doc.text}
-	case *cond:
-		out <- &condElt{elt{-1}, doc.small, doc.continuation, doc.tail}
-	case *linebreak:
-		out <- &crlfElt{elt{-1}}
-	case *concat:
-		for _, elt := range doc.children {
-			visitElement(elt, out)
-		}
-	case *group:
-		out <- &gbegElt{elt{-1}}
-		visitElement(doc.child, out)
-		out <- &gendElt{elt{-1}}
-	case *nest:
-		out <- &nbegElt{elt{-1}}
-		out <- &gbegElt{elt{-1}}
-		visitElement(doc.child, out)
-		out <- &gendElt{elt{-1}}
-		out <- &nendElt{elt{-1}}
-	default:
-		panic("Couldn't understand document type")
-	}
+// The renderer is organized as a chain of pull-based stages, each of
+// which hands out one stream element at a time from `next`.  Each
+// stage corresponds to one of the phases in Kiselyov's paper; the
+// paper (and earlier versions of this package) ran them as coroutines,
+// but everything here runs on the caller's goroutine and the only
+// state is a handful of reusable slices.
+
+// docStream recursively converts a document into the stream elements
+// we'll be using.  Rather than recursing on the Go stack we keep an
+// explicit stack of work still to do, so that we can stop after every
+// element.
+type docStream struct {
+	todo []pending
 }
 
-// annotateLastChar is the next step; it takes the stream elements
-// from `toStream` and adds information about the horizontal position
-// of their last character.  This is not possible with NBeg and GBeg
-// elements as we haven't got enough information yet.
-func annotateLastChar(in <-chan streamElt) <-chan streamElt {
-	ch := make(chan streamElt)
-	go func() {
-		defer close(ch)
-		position := 0
-		for {
-			select {
-			case elt, ok := <-in:
-				if !ok {
-					return
+// pending is an entry on the docStream work stack; either a document
+// still to be visited or, if `doc` is nil, a closing element to emit.
+type pending struct {
+	doc Element
+	end eltKind
+}
+
+func toStream(document Element) *docStream {
+	return &docStream{todo: []pending{{doc: document}}}
+}
+
+func (s *docStream) push(doc Element) {
+	s.todo = append(s.todo, pending{doc: doc})
+}
+
+func (s *docStream) pushElt(kind eltKind) {
+	s.todo = append(s.todo, pending{end: kind})
+}
+
+func (s *docStream) next() (streamElt, bool) {
+	for len(s.todo) > 0 {
+		top := s.todo[len(s.todo)-1]
+		s.todo = s.todo[:len(s.todo)-1]
+		switch doc := top.doc.(type) {
+		case nil:
+			return streamElt{kind: top.end, hpos: -1}, true
+		case *text:
+			return streamElt{kind: textKind, hpos: -1, payload: doc.text}, true
+		case *cond:
+			s.push(doc.expansion)
+		case *linebreak:
+			if doc.literal {
+				return streamElt{kind: litCRKind, hpos: -1}, true
+			}
+			return streamElt{kind: crlfKind, hpos: -1}, true
+		case *lineSuffix:
+			s.pushElt(breakKind)
+			s.pushElt(suffixEndKind)
+			s.push(doc.child)
+			return streamElt{kind: suffixBegKind, hpos: -1}, true
+		case *breakParent:
+			return streamElt{kind: breakKind, hpos: -1}, true
+		case *dynamic:
+			return streamElt{kind: dynKind, hpos: -1, value: doc}, true
+		case *annotation:
+			s.pushElt(annEndKind)
+			s.push(doc.child)
+			return streamElt{kind: annBegKind, hpos: -1, value: doc.value}, true
+		case *mark:
+			s.pushElt(markEndKind)
+			s.push(doc.child)
+			return streamElt{kind: markBegKind, hpos: -1, value: doc.id}, true
+		case *verbatim:
+			s.push(doc.expansion)
+		case *concat:
+			for i := len(doc.children) - 1; i >= 0; i-- {
+				s.push(doc.children[i])
+			}
+		case *fill:
+			s.push(doc.expansion)
+		case *group:
+			s.pushElt(gendKind)
+			s.push(doc.child)
+			if doc.firstLine {
+				return streamElt{kind: gbegKind, hpos: -1, offset: measureFirstLine}, true
+			}
+			return streamElt{kind: gbegKind, hpos: -1}, true
+		case *nest:
+			s.pushElt(nendKind)
+			s.pushElt(gendKind)
+			s.push(doc.child)
+			s.pushElt(gbegKind)
+			return streamElt{kind: nbegKind, hpos: -1}, true
+		case *align:
+			s.pushElt(nendKind)
+			s.push(doc.child)
+			return streamElt{kind: nbegKind, hpos: -1, offset: doc.offset}, true
+		case *indent:
+			s.pushElt(nendKind)
+			s.push(doc.child)
+			return streamElt{kind: ibegKind, hpos: -1, offset: doc.offset}, true
+		case *prefix:
+			s.pushElt(pendKind)
+			s.push(doc.child)
+			return streamElt{kind: pbegKind, hpos: -1, payload: doc.prefix}, true
+		case *ifBreak:
+			s.pushElt(altEndKind)
+			s.push(doc.broken)
+			s.pushElt(altNextKind)
+			s.push(doc.flat)
+			return streamElt{kind: altBegKind, hpos: -1}, true
+		case *choice:
+			s.pushElt(altEndKind)
+			last := len(doc.alternatives) - 1
+			for i := last; i >= 0; i-- {
+				// Each alternative but the last is measured
+				// up to its first line break, so that the
+				// printer can see whether it fits.
+				if doc.firstFit && i < last {
+					s.pushElt(mendKind)
 				}
-				switch elt := elt.(type) {
-				case *textElt:
-					position += len(elt.payload)
-					elt.hpos = position
-					ch <- elt
-				case *condElt:
-					position += len(elt.small)
-					elt.hpos = position
-					ch <- elt
-				case *crlfElt:
-					elt.hpos = position
-					ch <- elt
-				case *gbegElt, *nbegElt:
-					// Don't have enough information yet to do this
-					// accurately.
-					ch <- elt
-				case *gendElt:
-					elt.hpos = position
-					ch <- elt
-				case *nendElt:
-					elt.hpos = position
-					ch <- elt
+				s.push(doc.alternatives[i])
+				if doc.firstFit && i < last {
+					s.pushElt(mbegKind)
 				}
+				if i > 0 {
+					s.pushElt(altNextKind)
+				}
+			}
+			if doc.firstFit {
+				return streamElt{kind: altBegKind, hpos: -1, offset: chooseFits}, true
 			}
+			return streamElt{kind: altBegKind, hpos: -1, offset: chooseFirst}, true
+		default:
+			panic("Couldn't understand document type")
 		}
-	}()
-	return ch
+	}
+	return streamElt{}, false
 }
 
-type lookaheads [][]streamElt
+// lastCharStream is the next step; it takes the stream elements from
+// `toStream` and adds information about the horizontal position of
+// their last character.  This is not possible with NBeg and GBeg
+// elements as we haven't got enough information yet.
+type lastCharStream struct {
+	in       *docStream
+	measure  Measurer
+	position int
+	alts     []altPositions
+	// suffixes holds where each open LineSuffix started; they don't
+	// take up any room on the line.
+	suffixes []int
+	// printer is where the output is going, if anywhere; it's used
+	// to guess where WithColumn and the like will end up.
+	printer *printer
+}
 
-func (s lookaheads) addToLast(element ...streamElt) {
-	last := len(s) - 1
-	s[last] = append(s[last], element...)
+// altPositions tracks where a set of alternatives started, and where
+// the first of them ended.
+type altPositions struct {
+	start, end int
 }
 
-func (s lookaheads) pushNew() lookaheads {
-	return append(s, make([]streamElt, 0))
+func annotateLastChar(in *docStream) *lastCharStream {
+	return &lastCharStream{in: in, measure: MeasureCells}
 }
 
-func (s lookaheads) pop() ([]streamElt, lookaheads) {
-	last := len(s) - 1
-	return s[last], s[0:last]
+func (s *lastCharStream) next() (streamElt, bool) {
+	elt, ok := s.in.next()
+	if !ok {
+		return elt, false
+	}
+	switch elt.kind {
+	case textKind:
+		s.position += s.measure(elt.payload)
+		elt.hpos = s.position
+	case dynKind:
+		s.position += s.guess(elt.value.(*dynamic)).Width()
+		elt.hpos = s.position
+	case gbegKind, mbegKind, nbegKind, ibegKind, pbegKind:
+		// Don't have enough information yet to do this accurately.
+	case altBegKind:
+		s.alts = append(s.alts, altPositions{s.position, -1})
+		elt.hpos = s.position
+	case suffixBegKind:
+		s.suffixes = append(s.suffixes, s.position)
+		elt.hpos = s.position
+	case suffixEndKind:
+		s.position = s.suffixes[len(s.suffixes)-1]
+		s.suffixes = s.suffixes[:len(s.suffixes)-1]
+		elt.hpos = s.position
+	case altNextKind, altEndKind:
+		top := &s.alts[len(s.alts)-1]
+		if top.end < 0 {
+			top.end = s.position
+		}
+		if elt.kind == altNextKind {
+			s.position = top.start
+		} else {
+			s.position = top.end
+			s.alts = s.alts[:len(s.alts)-1]
+		}
+		elt.hpos = s.position
+	default:
+		elt.hpos = s.position
+	}
+	return elt, true
 }
 
-// annotateGBeg is the next step; we take the horizontal position
+// guess evaluates `d` as it would be if there were no more line
+// breaks before it than the printer has got to so far.
+func (s *lastCharStream) guess(d *dynamic) Element {
+	p := s.printer
+	if p == nil {
+		return d.eval(s.position, 0, 0)
+	}
+	return d.eval(p.hpos+s.position-p.pos, p.Width, p.currentIndent().col)
+}
+
+// gbegStream is the next step; we take the horizontal position
 // information gotten from `annotateLastChar` and compute the `hpos`
 // for GBeg elements.  We don't need to do it for NBeg, but for GBeg
 // it matters for linebreaks.
-func annotateGBeg(in <-chan streamElt) <-chan streamElt {
-	ch := make(chan streamElt)
-	go func() {
-		defer close(ch)
-		var lookahead lookaheads
-		for {
-			select {
-			case element, ok := <-in:
-				if !ok {
-					return
-				}
-				switch element := element.(type) {
-				case *textElt, *condElt, *crlfElt, *nbegElt, *nendElt:
-					if len(lookahead) == 0 {
-						ch <- element
-					} else {
-						lookahead.addToLast(element)
-					}
-				case *gbegElt:
-					lookahead = lookahead.pushNew()
-				case *gendElt:
-					var top []streamElt
-					top, lookahead = lookahead.pop()
-					if len(lookahead) == 0 {
-						// this, then, was the topmost stack
-						ch <- &gbegElt{elt{element.hpos}}
-						for _, e := range top {
-							ch <- e
-						}
-						ch <- element
-					} else {
-						lookahead.addToLast(&gbegElt{elt{element.hpos}})
-						lookahead.addToLast(top...)
-						lookahead.addToLast(element)
-					}
-				}
+//
+// A GBeg can't be handed on until we know where its group ends, so
+// everything from the outermost open GBeg onwards is held in
+// `lookahead`; `groups` records each open GBeg so that its position
+// can be filled in place when the group ends.
+//
+// This also implements the alternate third phase from Kiselyov's
+// paper, which limits lookahead to the width of the page.  A group
+// can only fit on a line if it's at most `width` wide, so as soon as
+// the stream gets more than `width` past the start of the outermost
+// open group we know it won't fit; its GBeg gets `tooFar` as its
+// position, and everything up to the next open group can be handed on
+// straight away.  The paper assumes every element has nonzero width;
+// we don't, but zero width elements can't push a group past the edge
+// of the page either, so they are just held with the rest of the
+// group.  The lookahead is therefore bounded by the page width plus
+// however many zero width elements turn up in a row.
+//
+// Alternatives after the first don't count towards the width of the
+// groups around them, so there's no pruning while we're in one.
+type gbegStream struct {
+	in        *lastCharStream
+	width     int
+	position  int
+	lookahead []streamElt
+	groups    []openGroup
+	// alts records, for each open set of alternatives, whether
+	// we're past the first one; `later` counts how many are.
+	alts  []bool
+	later int
+	// suffixes counts the LineSuffix elements we're in.
+	suffixes int
+	// ready is how many elements at the front of `lookahead` are
+	// complete, and `read` how many of those have been handed on.
+	ready, read int
+}
+
+type openGroup struct {
+	// index is the position of the GBeg in the lookahead.
+	index int
+	// start is the stream position at which the group starts.
+	start int
+	// later is how many alternatives after the first the group is
+	// in.
+	later int
+	// broken is true once the group has a hard line break in it.
+	broken bool
+	// firstLine is true if the group is only being measured up to
+	// its first hard line break.
+	firstLine bool
+}
+
+// tooFar is the position given to groups which have been pruned;
+// it's further than any right edge.
+const tooFar = int(^uint(0) >> 1)
+
+func annotateGBeg(in *lastCharStream, width int) *gbegStream {
+	return &gbegStream{in: in, width: width}
+}
+
+func (s *gbegStream) next() (streamElt, bool) {
+	for s.read == s.ready {
+		s.compact()
+		elt, ok := s.in.next()
+		if !ok {
+			return elt, false
+		}
+		switch elt.kind {
+		case gbegKind, mbegKind:
+			s.groups = append(s.groups, openGroup{index: len(s.lookahead),
+				start: s.position, later: s.later,
+				firstLine: elt.kind == mbegKind || elt.offset == measureFirstLine})
+			s.lookahead = append(s.lookahead, elt)
+		case gendKind, mendKind:
+			if len(s.groups) == 0 {
+				// The end of a group which has already been
+				// pruned.
+				return elt, true
+			}
+			last := len(s.groups) - 1
+			if !s.groups[last].broken {
+				s.lookahead[s.groups[last].index].hpos = elt.hpos
+			}
+			s.groups = s.groups[:last]
+			s.lookahead = append(s.lookahead, elt)
+			if len(s.groups) == 0 {
+				// this, then, was the topmost group
+				s.ready = len(s.lookahead)
+			}
+		default:
+			if elt.hpos >= 0 {
+				s.position = elt.hpos
 			}
+			s.trackAlts(elt)
+			switch elt.kind {
+			case suffixBegKind:
+				s.suffixes++
+			case suffixEndKind:
+				s.suffixes--
+			}
+			if len(s.groups) == 0 {
+				return elt, true
+			}
+			s.lookahead = append(s.lookahead, elt)
+			// A line suffix is always flat, so nothing in one
+			// breaks; the end of it does, though.
+			if s.suffixes == 0 && (elt.kind == crlfKind ||
+				elt.kind == litCRKind || elt.kind == breakKind) {
+				s.breakParents()
+			}
+			s.prune()
 		}
-	}()
-	return ch
-}
-
-// Kiselyov's original formulation includes an alternate third phase
-// which limits lookahead to the width of the page.  This is difficult
-// for us because we don't guarantee docs are of nonzero length,
-// although that could be finessed, and also it adds extra complexity
-// for minimal benefit.  This implementation skips it.
-
-// The final phase is to compute output.  Each time we see a
-// `gbeg_element_t`, we can compare its `hpos` with `rightEdge` to see
-// whether it'll fit without breaking.  If it does fit, increment
-// `fittingElements` and proceed, which will cause the logic for
-// `text_element_t` and `cond_element_t` to just append stuff without
-// line breaks.  If it doesn't fit, set `fittingElements` to 0, which
-// will cause `cond_element_t` to do line breaks.  When we do a line
-// break, we need to compute where the new right edge of the 'page'
-// would be in the context of the original stream; so if we saw a
-// `cond_element_t` with `e.hpos` of 300 (meaning it ends at
-// horizontal position 300), the new right edge would be 300 -
+	}
+	elt := s.lookahead[s.read]
+	s.read++
+	return elt, true
+}
+
+func (s *gbegStream) trackAlts(elt streamElt) {
+	switch elt.kind {
+	case altBegKind:
+		s.alts = append(s.alts, false)
+	case altNextKind:
+		if !s.alts[len(s.alts)-1] {
+			s.alts[len(s.alts)-1] = true
+			s.later++
+		}
+	case altEndKind:
+		if s.alts[len(s.alts)-1] {
+			s.later--
+		}
+		s.alts = s.alts[:len(s.alts)-1]
+	}
+}
+
+// breakParents breaks every open group around a hard line break,
+// since none of them can fit on one line.  That doesn't go past the
+// start of an alternative after the first, though; whether a group
+// fits only depends on its first alternatives.  Groups which are only
+// measured up to their first line break end here instead, as long as
+// the line break isn't in some ordinary group inside them.
+func (s *gbegStream) breakParents() {
+	firstLine := true
+	for i := len(s.groups) - 1; i >= 0 && s.groups[i].later == s.later; i-- {
+		if s.groups[i].broken {
+			break
+		}
+		s.groups[i].broken = true
+		firstLine = firstLine && s.groups[i].firstLine
+		if firstLine {
+			s.lookahead[s.groups[i].index].hpos = s.position
+		} else {
+			s.lookahead[s.groups[i].index].hpos = tooFar
+		}
+	}
+}
+
+// prune gives up on outermost groups which have got too wide to fit
+// on a line, or which are broken, and makes everything before the
+// next open group ready.
+func (s *gbegStream) prune() {
+	if s.later > 0 {
+		return
+	}
+	pruned := 0
+	for pruned < len(s.groups) && (s.groups[pruned].broken ||
+		s.position > s.groups[pruned].start+s.width) {
+		if !s.groups[pruned].broken {
+			s.lookahead[s.groups[pruned].index].hpos = tooFar
+		}
+		pruned++
+	}
+	if pruned == 0 {
+		return
+	}
+	s.groups = s.groups[:copy(s.groups, s.groups[pruned:])]
+	if len(s.groups) == 0 {
+		s.ready = len(s.lookahead)
+	} else {
+		s.ready = s.groups[0].index
+	}
+}
+
+// compact drops elements which have already been handed on from the
+// front of the lookahead.
+func (s *gbegStream) compact() {
+	if s.read == 0 {
+		return
+	}
+	s.lookahead = s.lookahead[:copy(s.lookahead, s.lookahead[s.read:])]
+	for i := range s.groups {
+		s.groups[i].index -= s.read
+	}
+	s.ready, s.read = 0, 0
+}
+
+// The final phase is to compute output.  Each time we see a GBeg, we
+// can compare its `hpos` with `rightEdge` to see whether it'll fit
+// without breaking.  If it does fit, increment `fittingElements` and
+// proceed, which will cause the logic for Text and Cond elements to
+// just append stuff without line breaks.  If it doesn't fit, set
+// `fittingElements` to 0, which will cause Cond elements to do line
+// breaks.  When we do a line break, we need to compute where the new
+// right edge of the 'page' would be in the context of the original
+// stream; so if we saw a Cond with `e.hpos` of 300 (meaning it ends
+// at horizontal position 300), the new right edge would be 300 -
 // indentation + page width.
-func output(in <-chan streamElt, width int, output io.Writer) error {
-	fittingElements := 0
-	rightEdge := width
-	hpos := 0
-	var indent []int
+//
+// Any error from `sink`, or `ctx` being cancelled, stops the whole
+// pipeline; since the earlier stages only do work when asked for an
+// element there's nothing else to tear down.
+type printer struct {
+	Options
+	sink            Sink
+	fittingElements int
+	rightEdge       int
+	// hpos is the column we're at, and `pos` the position in the
+	// stream that corresponds to.
+	hpos, pos int
+	// lineStart is the indentation of the current line.
+	lineStart int
+	indent    []indentation
+	// indentChunk is IndentChar over and over, if it's neither a
+	// space nor a tab, kept from one document to the next.
+	indentChunk string
+	// prefixes holds the text written at the start of each line, and
+	// the column to write it at.
+	prefixes []linePrefix
+	// trailing is whitespace that hasn't been written yet, because
+	// it might turn out to be at the end of a line: indentation, and
+	// with TrimTrailingSpace, trailing whitespace in text.
+	trailing []string
+	// indented is how much of `trailing` is the current line's
+	// indentation, as opposed to whitespace from text.
+	indented int
+	// lineBreak is true if the current line hasn't been started in
+	// `sink` yet.  That's left until there's some text on it, so that
+	// the whitespace before the text can go along with the line break
+	// as its indentation.
+	lineBreak bool
+	// alts holds the open sets of alternatives.  While `skip` is
+	// nonzero we're skipping an alternative that wasn't chosen; it
+	// counts how deeply nested in alternatives we are while doing so.
+	alts []alternatives
+	skip int
+	// deciding is true at the start of an alternative which is to be
+	// taken if it fits.
+	deciding bool
+	// lineSuffix holds the text and annotations to write at the end
+	// of the line, and `inSuffix` counts how many LineSuffix elements
+	// we're in.
+	lineSuffix []streamElt
+	inSuffix   int
+	// annotations holds the open annotations, the last `opening` of
+	// which haven't been reported yet since there's been no text in
+	// them; that way pending whitespace goes before them.
+	annotations []interface{}
+	opening     int
+	// written is how far the output has got in `sink`, counting each
+	// line break as Options.Newline.
+	written Position
+	// marks holds where each Mark ended up, in the order they start,
+	// and `openMarks` the indices of the ones still open, the last
+	// `markOpening` of which haven't started yet in the same way as
+	// annotations.
+	marks       []MarkSpan
+	openMarks   []int
+	markOpening int
+}
+
+// indentation is where lines start, and, with SmartTabs, how many
+// tabs (each counting as TabWidth columns) to get there with before
+// switching to spaces.  Tabs are counted from the last prefix.
+type indentation struct {
+	col, tabs int
+}
+
+type linePrefix struct {
+	text string
+	at   indentation
+}
+
+type alternatives struct {
+	chosen, current int
+}
+
+func (p *printer) reset(sink Sink, opts Options) {
+	p.Options = opts
+	p.sink = sink
+	if c := opts.IndentChar; c != ' ' && c != '\t' {
+		if r, _ := utf8.DecodeRuneInString(p.indentChunk); r != c {
+			p.indentChunk = strings.Repeat(string(c), len(spaces))
+		}
+	}
+	p.fittingElements = 0
+	p.rightEdge = opts.Width
+	p.hpos, p.pos, p.lineStart = 0, 0, 0
+	p.indent = p.indent[:0]
+	p.prefixes = p.prefixes[:0]
+	p.trailing, p.indented = p.trailing[:0], 0
+	p.lineBreak = false
+	p.alts = p.alts[:0]
+	p.skip = 0
+	p.deciding = false
+	p.lineSuffix = p.lineSuffix[:0]
+	p.inSuffix = 0
+	p.annotations = p.annotations[:0]
+	p.opening = 0
+	p.written = Position{}
+	p.marks = p.marks[:0]
+	p.openMarks = p.openMarks[:0]
+	p.markOpening = 0
+}
+
+func (p *printer) run(ctx context.Context, in *gbegStream) error {
+	done := ctx.Done()
 	for {
-		select {
-		case elt, ok := <-in:
-			if !ok {
-				return nil
+		if done != nil {
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
 			}
-			switch elt := elt.(type) {
-			case *textElt:
-				_, err := io.WriteString(output, elt.payload)
-				if err != nil {
-					return err
-				}
-				hpos += len(elt.payload)
-			case *condElt:
-				if fittingElements == 0 {
-					var currentIndent int
-					if len(indent) == 0 {
-						currentIndent = 0
-					} else {
-						currentIndent = indent[len(indent)-1]
-					}
-					_, err := io.WriteString(output, elt.tail)
-					if err != nil {
-						return err
-					}
-					_, err = io.WriteString(output, "\n")
-					if err != nil {
-						return err
-					}
-					_, err = io.WriteString(output, strings.Repeat(" ", currentIndent))
-					if err != nil {
-						return err
-					}
-					_, err = io.WriteString(output, elt.cont)
-					if err != nil {
-						return err
-					}
-					fittingElements = 0
-					hpos = currentIndent + len(elt.cont)
-					rightEdge = (width - hpos) + elt.hpos
-				} else {
-					_, err := io.WriteString(output, elt.small)
-					if err != nil {
-						return err
-					}
-					hpos += len(elt.small)
-				}
-			case *crlfElt:
-				var currentIndent int
-				if len(indent) == 0 {
-					currentIndent = 0
-				} else {
-					currentIndent = indent[len(indent)-1]
-				}
-				_, err := io.WriteString(output, "\n")
-				if err != nil {
-					return err
-				}
-				_, err = io.WriteString(output, strings.Repeat(" ", currentIndent))
-				if err != nil {
-					return err
-				}
-				fittingElements = 0
-				hpos = currentIndent
-				rightEdge = (width - hpos) + elt.hpos
-			case *gbegElt:
-				if fittingElements != 0 || elt.hpos <= rightEdge {
-					fittingElements++
-				} else {
-					fittingElements = 0
-				}
-			case *gendElt:
-				if fittingElements != 0 {
-					fittingElements--
-				}
-			case *nbegElt:
-				indent = append(indent, hpos)
-			case *nendElt:
-				if len(indent) > 0 {
-					indent = indent[0 : len(indent)-1]
-				}
+		}
+		elt, ok := in.next()
+		if !ok {
+			return p.finish()
+		}
+		if err := p.print(elt); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *printer) print(elt streamElt) error {
+	if p.skip > 0 {
+		p.skipAlternative(elt)
+		return nil
+	}
+	if p.inSuffix > 0 {
+		p.bufferSuffix(elt)
+		return nil
+	}
+	if p.deciding {
+		// The alternatives which might not fit all start with an
+		// MBeg; the last one doesn't, and is used if none of the
+		// others fit.
+		p.deciding = false
+		if elt.kind == mbegKind && !p.fits(elt.hpos) {
+			p.skip = 1
+			return nil
+		}
+		top := &p.alts[len(p.alts)-1]
+		top.chosen = top.current
+	}
+	switch elt.kind {
+	case textKind:
+		p.pos = elt.hpos
+		return p.write(elt.payload)
+	case crlfKind, litCRKind:
+		p.pos = elt.hpos
+		if err := p.newline(elt.kind == litCRKind); err != nil {
+			return err
+		}
+		p.fittingElements = 0
+		p.rightEdge = (p.Width - p.hpos) + elt.hpos
+	case gbegKind:
+		if p.fittingElements != 0 || p.fits(elt.hpos) {
+			p.fittingElements++
+		} else {
+			p.fittingElements = 0
+		}
+	case gendKind:
+		if p.fittingElements != 0 {
+			p.fittingElements--
+		}
+	case altBegKind:
+		// For an IfBreak, the first alternative is flat and the
+		// second broken.  If the group around a FirstFit fits,
+		// then so does its first alternative.
+		chosen := 0
+		if p.fittingElements == 0 {
+			switch elt.offset {
+			case chooseIfBreak:
+				chosen = 1
+			case chooseFits:
+				chosen = -1
+				p.deciding = true
+			}
+		}
+		p.alts = append(p.alts, alternatives{chosen: chosen})
+		if chosen > 0 {
+			p.skip = 1
+			if p.TrimTrailingSpace {
+				p.trimTrailing()
+			}
+		}
+	case altNextKind:
+		// That's the end of the chosen alternative.
+		p.skip = 1
+	case altEndKind:
+		p.endAlternatives(elt)
+	case nbegKind:
+		p.pushIndent(indentation{p.hpos + elt.offset, p.currentIndent().tabs})
+	case ibegKind:
+		indent := p.currentIndent()
+		if !p.SmartTabs {
+			indent.col += elt.offset
+		} else if elt.offset > 0 {
+			indent.col += p.TabWidth
+			indent.tabs++
+		} else if elt.offset < 0 {
+			indent.col -= p.TabWidth
+			indent.tabs--
+		}
+		p.pushIndent(indent)
+	case nendKind:
+		p.popIndent()
+	case pbegKind:
+		at := p.currentIndent()
+		p.prefixes = append(p.prefixes, linePrefix{elt.payload, at})
+		p.pushIndent(indentation{at.col + p.Measure(elt.payload), 0})
+	case pendKind:
+		p.prefixes = p.prefixes[:len(p.prefixes)-1]
+		p.popIndent()
+	case suffixBegKind:
+		p.inSuffix++
+	case dynKind:
+		return p.dynamic(elt)
+	case annBegKind:
+		return p.beginAnnotation(elt.value)
+	case annEndKind:
+		return p.endAnnotation()
+	case markBegKind:
+		p.beginMark(elt.value)
+	case markEndKind:
+		p.endMark()
+	}
+	return nil
+}
+
+// beginAnnotation starts an annotation, although it isn't reported
+// until there's some text in it.
+func (p *printer) beginAnnotation(ann interface{}) error {
+	p.annotations = append(p.annotations, ann)
+	p.opening++
+	if len(p.trailing) == 0 && !p.lineBreak {
+		return p.openAnnotations()
+	}
+	return nil
+}
+
+// openAnnotations reports the annotations which have started since
+// the last text.
+func (p *printer) openAnnotations() error {
+	for _, ann := range p.annotations[len(p.annotations)-p.opening:] {
+		if err := p.sink.BeginAnnotation(ann); err != nil {
+			return err
+		}
+	}
+	p.opening = 0
+	return nil
+}
+
+// endAnnotation ends the innermost annotation; if it was never
+// reported, it doesn't need to be now either.
+func (p *printer) endAnnotation() error {
+	last := len(p.annotations) - 1
+	ann := p.annotations[last]
+	p.annotations[last] = nil
+	p.annotations = p.annotations[:last]
+	if p.opening > 0 {
+		p.opening--
+		return nil
+	}
+	return p.sink.EndAnnotation(ann)
+}
+
+// beginMark starts a mark, although like an annotation it doesn't
+// start in the output until there's some text in it.
+func (p *printer) beginMark(id interface{}) {
+	p.openMarks = append(p.openMarks, len(p.marks))
+	p.marks = append(p.marks, MarkSpan{ID: id})
+	p.markOpening++
+	if len(p.trailing) == 0 && !p.lineBreak {
+		p.startMarks()
+	}
+}
+
+// startMarks starts the marks which have begun since the last text
+// where the output's got to.
+func (p *printer) startMarks() {
+	for _, i := range p.openMarks[len(p.openMarks)-p.markOpening:] {
+		p.marks[i].Start = p.written
+	}
+	p.markOpening = 0
+}
+
+// endMark ends the innermost mark.  One with no text in it starts and
+// ends at the same place.
+func (p *printer) endMark() {
+	last := len(p.openMarks) - 1
+	i := p.openMarks[last]
+	p.openMarks = p.openMarks[:last]
+	if p.markOpening > 0 {
+		p.markOpening--
+		p.marks[i].Start = p.written
+	}
+	p.marks[i].End = p.written
+}
+
+// dynamic prints what a WithColumn or the like turns out to be, now
+// that we know exactly where it goes.  It gets a pipeline of its own,
+// with positions counted from where it starts.
+func (p *printer) dynamic(elt streamElt) error {
+	doc := elt.value.(*dynamic).eval(p.hpos, p.Width, p.currentIndent().col)
+	sub := newPipeline(doc, nil, p.Options)
+	defer sub.release()
+	sub.chars.printer = p
+	p.pos = 0
+	p.rightEdge = p.Width - p.hpos
+	for {
+		e, ok := sub.groups.next()
+		if !ok {
+			break
+		}
+		if err := p.print(e); err != nil {
+			return err
+		}
+	}
+	p.pos = elt.hpos
+	p.rightEdge = (p.Width - p.hpos) + p.pos
+	return nil
+}
+
+// bufferSuffix saves the text of a LineSuffix for the end of the line.
+// It's always printed flat, so only the first of any alternatives is
+// kept, and anything else is ignored.  WithColumn and the like are
+// kept as they are, to be worked out where they end up.
+func (p *printer) bufferSuffix(elt streamElt) {
+	switch elt.kind {
+	case textKind, annBegKind, annEndKind, markBegKind, markEndKind, dynKind:
+		p.lineSuffix = append(p.lineSuffix, elt)
+	case altBegKind:
+		p.alts = append(p.alts, alternatives{})
+	case altNextKind:
+		p.skip = 1
+	case altEndKind:
+		p.alts = p.alts[:len(p.alts)-1]
+	case suffixBegKind:
+		p.inSuffix++
+	case suffixEndKind:
+		p.inSuffix--
+		if p.inSuffix == 0 {
+			p.pos = elt.hpos
+			p.rightEdge = (p.Width - p.hpos) + p.pos
+		}
+	}
+}
+
+// flushSuffix writes any line suffixes there are.
+func (p *printer) flushSuffix() error {
+	err := p.writeSuffix(p.lineSuffix)
+	for i := range p.lineSuffix {
+		p.lineSuffix[i] = streamElt{}
+	}
+	p.lineSuffix = p.lineSuffix[:0]
+	return err
+}
+
+// writeSuffix writes the buffered elements of a line suffix.
+func (p *printer) writeSuffix(suffix []streamElt) error {
+	for _, elt := range suffix {
+		var err error
+		switch elt.kind {
+		case textKind:
+			err = p.write(elt.payload)
+		case annBegKind:
+			err = p.beginAnnotation(elt.value)
+		case annEndKind:
+			err = p.endAnnotation()
+		case markBegKind:
+			p.beginMark(elt.value)
+		case markEndKind:
+			p.endMark()
+		case dynKind:
+			err = p.dynamicSuffix(elt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dynamicSuffix writes a WithColumn or the like from a line suffix,
+// now that we're where it goes.  What it turns out to be is buffered
+// in the same way as the rest of the suffix, and then written; the
+// rest of the line is already laid out, so the position in the stream
+// is left alone.
+func (p *printer) dynamicSuffix(elt streamElt) error {
+	pos, rightEdge, outer := p.pos, p.rightEdge, p.lineSuffix
+	p.lineSuffix = nil
+	p.inSuffix++
+	// It's all buffered, so there's nothing to go wrong.
+	_ = p.dynamic(elt)
+	p.inSuffix--
+	suffix := p.lineSuffix
+	p.pos, p.rightEdge, p.lineSuffix = pos, rightEdge, outer
+	return p.writeSuffix(suffix)
+}
+
+// finish writes what's left at the end of the document: any line
+// suffixes, and the line break at the end if there is one.
+func (p *printer) finish() error {
+	if err := p.flushSuffix(); err != nil {
+		return err
+	}
+	if p.lineBreak {
+		p.lineBreak = false
+		if err := p.startLine(""); err != nil {
+			return err
+		}
+	}
+	return p.sink.Flush()
+}
+
+func (p *printer) skipAlternative(elt streamElt) {
+	switch elt.kind {
+	case altBegKind:
+		p.skip++
+	case altNextKind:
+		if p.skip == 1 {
+			top := &p.alts[len(p.alts)-1]
+			top.current++
+			if top.current == top.chosen {
+				p.skip = 0
+			} else if top.chosen < 0 {
+				p.skip = 0
+				p.deciding = true
 			}
 		}
+	case altEndKind:
+		p.skip--
+		if p.skip == 0 {
+			p.endAlternatives(elt)
+		}
+	}
+}
+
+// endAlternatives picks the stream back up after the last of a set
+// of alternatives; the position jumps to the end of the first
+// alternative, wherever we ended up.
+func (p *printer) endAlternatives(elt streamElt) {
+	p.alts = p.alts[:len(p.alts)-1]
+	p.pos = elt.hpos
+	p.rightEdge = (p.Width - p.hpos) + p.pos
+}
+
+// fits reports whether the stream up to `end` fits on the current
+// line, both within the page and within the ribbon.
+func (p *printer) fits(end int) bool {
+	if end > p.rightEdge {
+		return false
 	}
+	return p.RibbonWidth <= 0 || p.hpos+(end-p.pos)-p.lineStart <= p.RibbonWidth
+}
+
+func (p *printer) currentIndent() indentation {
+	if len(p.indent) == 0 {
+		return indentation{}
+	}
+	return p.indent[len(p.indent)-1]
+}
+
+func (p *printer) pushIndent(indent indentation) {
+	if indent.col < 0 {
+		indent.col = 0
+	}
+	if indent.tabs < 0 {
+		indent.tabs = 0
+	}
+	p.indent = append(p.indent, indent)
+}
+
+func (p *printer) popIndent() {
+	if len(p.indent) > 0 {
+		p.indent = p.indent[0 : len(p.indent)-1]
+	}
+}
+
+// newline ends the current line and starts the next one with any
+// prefixes and indentation.  The line break itself, and the
+// indentation, are only written once there's something else on the
+// line, so blank lines stay blank.  A `literal` line break leaves out
+// the indentation altogether.
+func (p *printer) newline(literal bool) error {
+	if err := p.flushSuffix(); err != nil {
+		return err
+	}
+	if p.lineBreak {
+		// The line we're ending was blank.
+		if err := p.startLine(""); err != nil {
+			return err
+		}
+	}
+	p.trailing, p.indented = p.trailing[:0], 0
+	p.lineBreak = true
+	p.hpos = 0
+	for _, prefix := range p.prefixes {
+		p.indentTo(prefix.at)
+		content := strings.TrimRight(prefix.text, " \t")
+		if err := p.write(content); err != nil {
+			return err
+		}
+		p.hpos += p.Measure(prefix.text[len(content):])
+		p.whitespace(prefix.text[len(content):])
+	}
+	if !literal {
+		p.indentTo(p.currentIndent())
+	}
+	p.lineStart = p.hpos
+	p.indented = len(p.trailing)
+	return nil
+}
+
+// spaces is written in chunks for indentation, which saves building
+// a new string for every line break.
+const spaces = "                                                                "
+const tabs = "\t\t\t\t\t\t\t\t\t\t\t\t\t\t\t\t"
+
+// indentTo indents up to `indent`.
+func (p *printer) indentTo(indent indentation) {
+	if p.SmartTabs && indent.tabs > 0 {
+		p.tabTo(indent.col, indent.tabs)
+	} else if p.IndentChar == '\t' {
+		p.tabTo(indent.col, indent.col)
+	}
+	n := indent.col - p.hpos
+	if n <= 0 {
+		return
+	}
+	p.hpos += n
+	switch p.IndentChar {
+	case ' ', '\t':
+		p.repeat(spaces, n)
+	default:
+		// The chunk is whole characters, each as long as the rest.
+		size := len(p.indentChunk) / len(spaces)
+		p.repeat(p.indentChunk, n*size)
+	}
+}
+
+// tabTo indents with as many tabs as it can up to `most`, without
+// going past `col`.  Each tab goes to the next tab stop, which after a
+// prefix mightn't be a whole TabWidth away.
+func (p *printer) tabTo(col, most int) {
+	next := (p.hpos/p.TabWidth + 1) * p.TabWidth
+	if next > col || most <= 0 {
+		return
+	}
+	t := 1 + (col-next)/p.TabWidth
+	if t > most {
+		t = most
+	}
+	p.hpos = next + (t-1)*p.TabWidth
+	p.repeat(tabs, t)
+}
+
+// repeat adds the first `n` bytes of `chunk`, over and over, to the
+// pending whitespace.
+func (p *printer) repeat(chunk string, n int) {
+	for n > 0 {
+		c := n
+		if c > len(chunk) {
+			c = len(chunk)
+		}
+		p.whitespace(chunk[:c])
+		n -= c
+	}
+}
+
+// write writes text to the current line, after any pending
+// whitespace.  With TrimTrailingSpace, whitespace at the end of the
+// text is held back in case it turns out to be at the end of the line.
+func (p *printer) write(payload string) error {
+	if payload == "" {
+		return nil
+	}
+	p.hpos += p.Measure(payload)
+	content := payload
+	if p.TrimTrailingSpace {
+		content = strings.TrimRight(payload, " \t")
+		if content == "" {
+			p.whitespace(payload)
+			return nil
+		}
+	}
+	if p.lineBreak || len(p.trailing) > 0 {
+		if err := p.flushTrailing(); err != nil {
+			return err
+		}
+	}
+	if p.opening > 0 {
+		if err := p.openAnnotations(); err != nil {
+			return err
+		}
+	}
+	if p.markOpening > 0 {
+		p.startMarks()
+	}
+	p.whitespace(payload[len(content):])
+	return p.emit(content)
+}
+
+// flushTrailing writes the pending whitespace, or if the line hasn't
+// been started yet, starts it with the whitespace as its indentation.
+func (p *printer) flushTrailing() error {
+	if p.lineBreak {
+		p.lineBreak = false
+		if err := p.startLine(strings.Join(p.trailing, "")); err != nil {
+			return err
+		}
+	} else {
+		for _, ws := range p.trailing {
+			if err := p.emit(ws); err != nil {
+				return err
+			}
+		}
+	}
+	p.trailing, p.indented = p.trailing[:0], 0
+	return nil
+}
+
+// trimTrailing drops whitespace from text at the end of the line so
+// far, ahead of the tail of a broken Cond.
+func (p *printer) trimTrailing() {
+	ws := p.trailing[p.indented:]
+	if len(ws) == 0 {
+		return
+	}
+	w := 0
+	for _, s := range ws {
+		w += p.Measure(s)
+	}
+	p.hpos -= w
+	p.rightEdge += w
+	p.trailing = p.trailing[:p.indented]
+}
+
+// whitespace adds to the whitespace which will be written before the
+// next text, and dropped if there's a line break first.
+func (p *printer) whitespace(ws string) {
+	if ws != "" {
+		p.trailing = append(p.trailing, ws)
+	}
+}
+
+func (p *printer) emit(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	p.written.Column += len(s)
+	p.written.Offset += len(s)
+	return p.sink.WriteText(s)
+}
+
+// startLine ends the line in `sink` and starts the next with `indent`.
+func (p *printer) startLine(indent string) error {
+	p.written.Line++
+	p.written.Column = len(indent)
+	p.written.Offset += len(p.Newline) + len(indent)
+	return p.sink.Newline(indent)
+}
+
+// pipeline bundles the stages together so that their buffers can be
+// reused from one document to the next.
+type pipeline struct {
+	docs    docStream
+	chars   lastCharStream
+	groups  gbegStream
+	printer printer
+	best    bestFit
+	// text is the sink for Render, kept here so that it's reused too.
+	text TextSink
+}
+
+var pipelines = sync.Pool{
+	New: func() interface{} { return new(pipeline) },
+}
+
+func newPipeline(doc Element, sink Sink, opts Options) *pipeline {
+	p := pipelines.Get().(*pipeline)
+	p.docs.todo = append(p.docs.todo[:0], pending{doc: doc})
+	p.best.todo = append(p.best.todo[:0], command{pending: pending{doc: doc}})
+	p.chars = lastCharStream{in: &p.docs, measure: opts.Measure,
+		alts: p.chars.alts[:0], suffixes: p.chars.suffixes[:0],
+		printer: &p.printer}
+	p.groups.in = &p.chars
+	p.groups.width = opts.Width
+	p.groups.position = 0
+	p.groups.lookahead = p.groups.lookahead[:0]
+	p.groups.groups = p.groups.groups[:0]
+	p.groups.ready, p.groups.read = 0, 0
+	p.groups.alts = p.groups.alts[:0]
+	p.groups.later = 0
+	p.groups.suffixes = 0
+	p.printer.reset(sink, opts)
+	return p
+}
+
+// writeTo sends the output to `out` as plain text.
+func (p *pipeline) writeTo(out io.Writer) {
+	p.text = TextSink{w: out, LineEnding: p.printer.Newline}
+	p.printer.sink = &p.text
+}
+
+// run prints the document with the algorithm from the options.
+func (p *pipeline) run(ctx context.Context) error {
+	if p.printer.Algorithm == BestFit {
+		return p.best.run(ctx, &p.printer)
+	}
+	return p.printer.run(ctx, &p.groups)
+}
+
+func (p *pipeline) release() {
+	// Don't let the pool keep documents alive.
+	todo := p.docs.todo[:cap(p.docs.todo)]
+	for i := range todo {
+		todo[i] = pending{}
+	}
+	for _, commands := range [][]command{p.best.todo, p.best.lookahead} {
+		commands = commands[:cap(commands)]
+		for i := range commands {
+			commands[i] = command{}
+		}
+	}
+	lookahead := p.groups.lookahead[:cap(p.groups.lookahead)]
+	for i := range lookahead {
+		lookahead[i] = streamElt{}
+	}
+	suffix := p.printer.lineSuffix[:cap(p.printer.lineSuffix)]
+	for i := range suffix {
+		suffix[i] = streamElt{}
+	}
+	annotations := p.printer.annotations[:cap(p.printer.annotations)]
+	for i := range annotations {
+		annotations[i] = nil
+	}
+	trailing := p.printer.trailing[:cap(p.printer.trailing)]
+	for i := range trailing {
+		trailing[i] = ""
+	}
+	marks := p.printer.marks[:cap(p.printer.marks)]
+	for i := range marks {
+		marks[i] = MarkSpan{}
+	}
+	p.printer.sink = nil
+	p.text = TextSink{}
+	pipelines.Put(p)
 }
 
 // PrettyPrint prints `doc` to `out` assuming a right page edge of
 // `width`.
 func PrettyPrint(doc Element, width int, out io.Writer) error {
-	return output(annotateGBeg(annotateLastChar(toStream(doc))), width, out)
+	return Render(doc, out, Options{Width: width})
+}
+
+// PrettyPrintContext is like PrettyPrint, but gives up with
+// `ctx.Err()` if `ctx` is cancelled before `doc` has been printed.
+func PrettyPrintContext(ctx context.Context, doc Element, width int, out io.Writer) error {
+	return RenderContext(ctx, doc, out, Options{Width: width})
 }
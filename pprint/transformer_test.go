@@ -2,17 +2,22 @@ package pprint
 
 import (
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
-func assertStream(t *testing.T, in <-chan streamElt, elements ...string) {
+type stream interface {
+	next() (streamElt, bool)
+}
+
+func assertStream(t *testing.T, in stream, elements ...string) {
 	for _, element := range elements {
-		elt, ok := <-in
+		elt, ok := in.next()
 		if assert.True(t, ok) {
 			assert.Equal(t, element, elt.String())
 		}
 	}
-	_, ok := <-in
+	_, ok := in.next()
 	assert.False(t, ok)
 }
 
@@ -61,7 +66,12 @@ func TestStreamification(t *testing.T) {
 		`GEnd(-1)`,
 		`NEnd(-1)`,
 		`TE(-1,")")`,
-		`CE(-1,".",".","")`,
+		`ABeg(-1)`,
+		`TE(-1,".")`,
+		`ANext(-1)`,
+		`CR(-1)`,
+		`TE(-1,".")`,
+		`AEnd(-1)`,
 		`TE(-1,"mul")`,
 		`TE(-1,"(")`,
 		`NBeg(-1)`,
@@ -79,7 +89,11 @@ func TestStreamification(t *testing.T) {
 		`GEnd(-1)`,
 		`NEnd(-1)`,
 		`TE(-1,",")`,
-		`CE(-1," ","","")`,
+		`ABeg(-1)`,
+		`TE(-1," ")`,
+		`ANext(-1)`,
+		`CR(-1)`,
+		`AEnd(-1)`,
 		`TE(-1,"mul")`,
 		`TE(-1,"(")`,
 		`NBeg(-1)`,
@@ -100,7 +114,11 @@ func TestStreamification(t *testing.T) {
 		`NEnd(-1)`,
 		`TE(-1,")")`,
 		`TE(-1,",")`,
-		`CE(-1," ","","")`,
+		`ABeg(-1)`,
+		`TE(-1," ")`,
+		`ANext(-1)`,
+		`CR(-1)`,
+		`AEnd(-1)`,
 		`TE(-1,"mul")`,
 		`TE(-1,"(")`,
 		`NBeg(-1)`,
@@ -173,7 +191,12 @@ func TestLastChar(t *testing.T) {
 		`GEnd(26)`,
 		`NEnd(26)`,
 		`TE(27,")")`,
-		`CE(28,".",".","")`,
+		`ABeg(27)`,
+		`TE(28,".")`,
+		`ANext(27)`,
+		`CR(27)`,
+		`TE(28,".")`,
+		`AEnd(28)`,
 		`TE(31,"mul")`,
 		`TE(32,"(")`,
 		`NBeg(-1)`,
@@ -191,7 +214,11 @@ func TestLastChar(t *testing.T) {
 		`GEnd(40)`,
 		`NEnd(40)`,
 		`TE(41,",")`,
-		`CE(42," ","","")`,
+		`ABeg(41)`,
+		`TE(42," ")`,
+		`ANext(41)`,
+		`CR(41)`,
+		`AEnd(42)`,
 		`TE(45,"mul")`,
 		`TE(46,"(")`,
 		`NBeg(-1)`,
@@ -212,7 +239,11 @@ func TestLastChar(t *testing.T) {
 		`NEnd(54)`,
 		`TE(55,")")`,
 		`TE(56,",")`,
-		`CE(57," ","","")`,
+		`ABeg(56)`,
+		`TE(57," ")`,
+		`ANext(56)`,
+		`CR(56)`,
+		`AEnd(57)`,
 		`TE(60,"mul")`,
 		`TE(61,"(")`,
 		`NBeg(-1)`,
@@ -248,7 +279,7 @@ func TestGBeg(t *testing.T) {
 			Funcall("mul", DottedList(Funcall("expr", Text("17")))),
 			Funcall("mul", DottedList(Funcall("expr", Text("17"))))))
 
-	ch := annotateGBeg(annotateLastChar(toStream(doc)))
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
 	assertStream(t, ch,
 		`TE(4,"expr")`,
 		`TE(5,"(")`,
@@ -285,7 +316,12 @@ func TestGBeg(t *testing.T) {
 		`GEnd(26)`,
 		`NEnd(26)`,
 		`TE(27,")")`,
-		`CE(28,".",".","")`,
+		`ABeg(27)`,
+		`TE(28,".")`,
+		`ANext(27)`,
+		`CR(27)`,
+		`TE(28,".")`,
+		`AEnd(28)`,
 		`TE(31,"mul")`,
 		`TE(32,"(")`,
 		`NBeg(-1)`,
@@ -303,7 +339,11 @@ func TestGBeg(t *testing.T) {
 		`GEnd(40)`,
 		`NEnd(40)`,
 		`TE(41,",")`,
-		`CE(42," ","","")`,
+		`ABeg(41)`,
+		`TE(42," ")`,
+		`ANext(41)`,
+		`CR(41)`,
+		`AEnd(42)`,
 		`TE(45,"mul")`,
 		`TE(46,"(")`,
 		`NBeg(-1)`,
@@ -324,7 +364,11 @@ func TestGBeg(t *testing.T) {
 		`NEnd(54)`,
 		`TE(55,")")`,
 		`TE(56,",")`,
-		`CE(57," ","","")`,
+		`ABeg(56)`,
+		`TE(57," ")`,
+		`ANext(56)`,
+		`CR(56)`,
+		`AEnd(57)`,
 		`TE(60,"mul")`,
 		`TE(61,"(")`,
 		`NBeg(-1)`,
@@ -351,3 +395,262 @@ func TestGBeg(t *testing.T) {
 		`NEnd(71)`,
 	)
 }
+
+func TestPrunedGBeg(t *testing.T) {
+	doc := Group(Concat(Text("aaaa"), CondLB, Group(Text("bbbb")), CondLB,
+		Text("cccc")))
+
+	// With plenty of room the group is measured as usual...
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 20)
+	assertStream(t, ch,
+		`GBeg(14)`,
+		`TE(4,"aaaa")`,
+		`ABeg(4)`,
+		`TE(5," ")`,
+		`ANext(4)`,
+		`CR(4)`,
+		`AEnd(5)`,
+		`GBeg(9)`,
+		`TE(9,"bbbb")`,
+		`GEnd(9)`,
+		`ABeg(9)`,
+		`TE(10," ")`,
+		`ANext(9)`,
+		`CR(9)`,
+		`AEnd(10)`,
+		`TE(14,"cccc")`,
+		`GEnd(14)`,
+	)
+
+	// ...but once it's gone past the edge of the page we give up on
+	// it without waiting for the end.
+	ch = annotateGBeg(annotateLastChar(toStream(doc)), 6)
+	assertStream(t, ch,
+		`GBeg(9223372036854775807)`,
+		`TE(4,"aaaa")`,
+		`ABeg(4)`,
+		`TE(5," ")`,
+		`ANext(4)`,
+		`CR(4)`,
+		`AEnd(5)`,
+		`GBeg(9)`,
+		`TE(9,"bbbb")`,
+		`GEnd(9)`,
+		`ABeg(9)`,
+		`TE(10," ")`,
+		`ANext(9)`,
+		`CR(9)`,
+		`AEnd(10)`,
+		`TE(14,"cccc")`,
+		`GEnd(14)`,
+	)
+}
+
+func TestBoundedLookahead(t *testing.T) {
+	words := make([]Element, 0, 20000)
+	for i := 0; i < 10000; i++ {
+		words = append(words, Text("word"), CondLB)
+	}
+	doc := Group(Concat(words...))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 20)
+	_, ok := ch.next()
+	if assert.True(t, ok) {
+		// We shouldn't have had to read the whole group to start
+		// producing output.
+		assert.True(t, ch.in.position < 100, ch.in.position)
+	}
+	longest := len(ch.lookahead)
+	for _, ok := ch.next(); ok; _, ok = ch.next() {
+		if len(ch.lookahead) > longest {
+			longest = len(ch.lookahead)
+		}
+	}
+	assert.True(t, longest < 40, longest)
+}
+
+func TestZeroWidthGroups(t *testing.T) {
+	empties := make([]Element, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		empties = append(empties, Group(Empty))
+	}
+	doc := Concat(Text("a"), Group(Concat(Concat(empties...), CondLB,
+		Text("b"))))
+
+	out, err := Output(doc, 3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a b", out)
+	}
+	out, err = Output(doc, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a\nb", out)
+	}
+}
+
+func TestIndentStream(t *testing.T) {
+	doc := Concat(Text("{"), Indent(4, Concat(LB, Text("a"))), LB, Text("}"))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`TE(1,"{")`,
+		`IBeg(-1,4)`,
+		`CR(1)`,
+		`TE(2,"a")`,
+		`NEnd(2)`,
+		`CR(2)`,
+		`TE(3,"}")`,
+	)
+}
+
+func TestAlignStream(t *testing.T) {
+	doc := Concat(Align(Text("a")), Hang(-2, Text("b")))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`NBeg(-1)`,
+		`TE(1,"a")`,
+		`NEnd(1)`,
+		`NBeg(-1,-2)`,
+		`TE(2,"b")`,
+		`NEnd(2)`,
+	)
+}
+
+func TestVerbatimStream(t *testing.T) {
+	doc := Concat(Verbatim("ab\r\n\n  c"), Literal("d\ne"))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`TE(2,"ab")`,
+		`CR(2)`,
+		`CR(2)`,
+		`TE(5,"  c")`,
+		`TE(6,"d")`,
+		`LitCR(6)`,
+		`TE(7,"e")`,
+	)
+}
+
+func TestBrokenGBeg(t *testing.T) {
+	doc := Group(Concat(Text("a"), Group(Concat(Text("b"), BreakParent)),
+		Group(Concat(Text("c"), CondLB, Text("d")))))
+
+	// The hard break gives up on the groups around it straight
+	// away, but not on the ones after it...
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`GBeg(9223372036854775807)`,
+		`TE(1,"a")`,
+		`GBeg(9223372036854775807)`,
+		`TE(2,"b")`,
+		`Break(2)`,
+		`GEnd(2)`,
+		`GBeg(5)`,
+		`TE(3,"c")`,
+		`ABeg(3)`,
+		`TE(4," ")`,
+		`ANext(3)`,
+		`CR(3)`,
+		`AEnd(4)`,
+		`TE(5,"d")`,
+		`GEnd(5)`,
+		`GEnd(5)`,
+	)
+
+	// ...and the line break in a broken Cond doesn't count at all.
+	doc = Group(Concat(Text("a"), CondLB, Text("b")))
+	ch = annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`GBeg(3)`,
+		`TE(1,"a")`,
+		`ABeg(1)`,
+		`TE(2," ")`,
+		`ANext(1)`,
+		`CR(1)`,
+		`AEnd(2)`,
+		`TE(3,"b")`,
+		`GEnd(3)`,
+	)
+}
+
+func TestLineSuffixStream(t *testing.T) {
+	doc := Group(Concat(Text("a"), LineSuffix(Text("bb")), Text("c")))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`GBeg(9223372036854775807)`,
+		`TE(1,"a")`,
+		`SBeg(1)`,
+		`TE(3,"bb")`,
+		`SEnd(1)`,
+		`Break(1)`,
+		`TE(2,"c")`,
+		`GEnd(2)`,
+	)
+}
+
+func TestFirstFitStream(t *testing.T) {
+	doc := FirstFit(Group(Concat(Text("a"), LB)),
+		Concat(Text("bb"), LB, Text("c")), Text("d"))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`ABeg(0,2)`,
+		`MBeg(9223372036854775807)`,
+		`GBeg(9223372036854775807)`,
+		`TE(1,"a")`,
+		`CR(1)`,
+		`GEnd(1)`,
+		`MEnd(1)`,
+		`ANext(0)`,
+		`MBeg(2)`,
+		`TE(2,"bb")`,
+		`CR(2)`,
+		`TE(3,"c")`,
+		`MEnd(3)`,
+		`ANext(0)`,
+		`TE(1,"d")`,
+		`AEnd(1)`,
+	)
+}
+
+func TestDynamicStream(t *testing.T) {
+	doc := Concat(Text("ab"), WithColumn(func(col int) Element {
+		return Text(strings.Repeat(" ", col))
+	}), Text("c"))
+
+	// Without a printer to go on, the column is guessed from the
+	// position in the stream.
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`TE(2,"ab")`,
+		`Dyn(4)`,
+		`TE(5,"c")`,
+	)
+}
+
+func TestAnnotationStream(t *testing.T) {
+	doc := Concat(Text("a"), Annotate(1, Concat(Text("b"), Text("c"))))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`TE(1,"a")`,
+		`Ann(1,1)`,
+		`TE(2,"b")`,
+		`TE(3,"c")`,
+		`AnnEnd(3)`,
+	)
+}
+
+func TestMarkStream(t *testing.T) {
+	doc := Concat(Text("a"), Mark("b", Concat(Text("b"), Text("c"))))
+
+	ch := annotateGBeg(annotateLastChar(toStream(doc)), 80)
+	assertStream(t, ch,
+		`TE(1,"a")`,
+		`Mark(1,b)`,
+		`TE(2,"b")`,
+		`TE(3,"c")`,
+		`MarkEnd(3)`,
+	)
+}
@@ -1,12 +1,15 @@
 package pprint
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // Element is a catch all type for the various pretty printer
 // primitives.
 type Element interface {
-	// Width yields how many characters Element would take on a line
-	// without wrapping.
+	// Width yields how many columns Element would take on a line
+	// without wrapping, as measured by MeasureCells.
 	Width() int
 	// String renders the Element in a debug-suitable form.
 	String() string
@@ -22,7 +25,7 @@ type text struct {
 }
 
 func (d *text) Width() int {
-	return len(d.text)
+	return MeasureCells(d.text)
 }
 
 func (d *text) String() string {
@@ -39,10 +42,13 @@ func Text(payload string) Element {
 
 type cond struct {
 	small, continuation, tail string
+	// expansion is the equivalent IfBreak, which is what actually
+	// gets printed.
+	expansion Element
 }
 
 func (d *cond) Width() int {
-	return len(d.small)
+	return MeasureCells(d.small)
 }
 
 func (d *cond) String() string {
@@ -54,12 +60,115 @@ func (d *cond) private() {
 
 // Cond constructs an Element that, if there is room, will render
 // as `small`; if there is not room, it will render as `tail`, a line
-// break, any required indentation, and then `cont`.
+// break, any required indentation, and then `cont`.  It's shorthand
+// for
+//
+//	IfBreak(Concat(Text(tail), LB, Text(cont)), Text(small))
 func Cond(small, cont, tail string) Element {
-	return &cond{small: small, continuation: cont, tail: tail}
+	broken := make([]Element, 0, 3)
+	if tail != "" {
+		broken = append(broken, Text(tail))
+	}
+	broken = append(broken, LB)
+	if cont != "" {
+		broken = append(broken, Text(cont))
+	}
+	return &cond{small: small, continuation: cont, tail: tail,
+		expansion: IfBreak(Concat(broken...), Text(small))}
+}
+
+type ifBreak struct {
+	broken, flat Element
+}
+
+func (d *ifBreak) Width() int {
+	return d.flat.Width()
+}
+
+func (d *ifBreak) String() string {
+	return fmt.Sprintf(`IfBreak(%s,%s)`, d.broken.String(), d.flat.String())
+}
+
+func (d *ifBreak) private() {
+}
+
+// IfBreak constructs an Element that renders as `broken` if the
+// enclosing `Group` or `Nest` is broken across lines, and as `flat` if
+// it fits on one.  As with `Cond`, outside of any group it is always
+// broken.  Only `flat` is taken into account when deciding whether
+// the enclosing group fits.
+func IfBreak(broken, flat Element) Element {
+	return &ifBreak{broken: broken, flat: flat}
+}
+
+type choice struct {
+	alternatives []Element
+	firstFit     bool
+}
+
+func (d *choice) Width() int {
+	return d.alternatives[0].Width()
+}
+
+func (d *choice) String() string {
+	w := "Choice("
+	if d.firstFit {
+		w = "FirstFit("
+	}
+	for i, elt := range d.alternatives {
+		if i > 0 {
+			w += ","
+		}
+		w += elt.String()
+	}
+	return w + ")"
+}
+
+func (d *choice) private() {
+}
+
+// Choice constructs an Element which is laid out as one of
+// `alternatives`, for when there are layouts which are different in
+// more than where the line breaks go.  The best fit renderer picks the
+// first alternative whose first line fits, or the last one if none of
+// them do; the alternatives are best given from the most to the least
+// compact.  The streaming renderer can't look ahead that far, so it
+// always uses the first alternative, and it's the first which is
+// measured when deciding whether the groups around a Choice fit.
+func Choice(alternatives ...Element) Element {
+	switch len(alternatives) {
+	case 0:
+		return Empty
+	case 1:
+		return alternatives[0]
+	}
+	return &choice{alternatives: alternatives}
+}
+
+// FirstFit constructs an Element which is laid out as the first of
+// `alternatives` that fits in the rest of the line, or as the last if
+// none of them do.  Each alternative but the last is measured flat,
+// up to its first hard line break (an LB, say, or the end of a
+// LineSuffix), so something like a function call which hugs a
+// multi-line last argument can still fit; but if that line break is
+// in a Group or Nest, the group can't be flat, so the alternative
+// doesn't fit.  The alternative is then
+// laid out as usual; put it in a Group if it should be flat when it
+// fits.  Unlike Choice, FirstFit is the same with either renderer.
+func FirstFit(alternatives ...Element) Element {
+	switch len(alternatives) {
+	case 0:
+		return Empty
+	case 1:
+		return alternatives[0]
+	}
+	return &choice{alternatives: alternatives, firstFit: true}
 }
 
 type linebreak struct {
+	// literal line breaks start the next line at the left margin,
+	// rather than at the current indentation.
+	literal bool
 }
 
 func (d *linebreak) Width() int {
@@ -67,12 +176,249 @@ func (d *linebreak) Width() int {
 }
 
 func (d *linebreak) String() string {
+	if d.literal {
+		return "LitCR"
+	}
 	return "CR"
 }
 
 func (d *linebreak) private() {
 }
 
+type breakParent struct {
+}
+
+func (d *breakParent) Width() int {
+	return 0
+}
+
+func (d *breakParent) String() string {
+	return "BreakParent"
+}
+
+func (d *breakParent) private() {
+}
+
+type lineSuffix struct {
+	child Element
+}
+
+func (d *lineSuffix) Width() int {
+	return 0
+}
+
+func (d *lineSuffix) String() string {
+	return fmt.Sprintf(`LineSuffix(%s)`, d.child.String())
+}
+
+func (d *lineSuffix) private() {
+}
+
+// LineSuffix constructs an Element which prints `e` at the end of the
+// line it's on, after whatever else ends up there; for instance a
+// trailing comment.  It's printed just before the next line break, or
+// at the end of the document, and always flat.  Since the line has to
+// end after it, it breaks the Group and Nest elements around it as
+// BreakParent does, and it doesn't count towards their width.
+func LineSuffix(e Element) Element {
+	return &lineSuffix{child: e}
+}
+
+// dynamicKind says what a dynamic element depends on.
+type dynamicKind uint8
+
+const (
+	dynamicColumn dynamicKind = iota
+	dynamicPageWidth
+	dynamicIndent
+)
+
+type dynamic struct {
+	kind dynamicKind
+	f    func(int) Element
+}
+
+func (d *dynamic) Width() int {
+	return d.eval(0, 0, 0).Width()
+}
+
+func (d *dynamic) String() string {
+	switch d.kind {
+	case dynamicColumn:
+		return "WithColumn(...)"
+	case dynamicPageWidth:
+		return "WithPageWidth(...)"
+	default:
+		return "WithIndent(...)"
+	}
+}
+
+func (d *dynamic) private() {
+}
+
+// eval works out the document given the current column, page width
+// and indentation.
+func (d *dynamic) eval(col, width, indent int) Element {
+	switch d.kind {
+	case dynamicColumn:
+		return d.f(col)
+	case dynamicPageWidth:
+		return d.f(width)
+	default:
+		return d.f(indent)
+	}
+}
+
+// WithColumn constructs an Element which is laid out as `f` of the
+// column it starts at.
+//
+// This, WithPageWidth and WithIndent are called while the document is
+// being printed, maybe more than once.  The streaming renderer has to
+// measure what they return before it knows exactly where it'll go, so
+// it calls them with its best guess first, and the groups around them
+// are measured using the Width of that.  What's printed is always from
+// the right column, though.  Their Width is that of `f(0)`.
+func WithColumn(f func(col int) Element) Element {
+	return &dynamic{kind: dynamicColumn, f: f}
+}
+
+// WithPageWidth constructs an Element which is laid out as `f` of the
+// width of the page it's printed on.
+func WithPageWidth(f func(width int) Element) Element {
+	return &dynamic{kind: dynamicPageWidth, f: f}
+}
+
+// WithIndent constructs an Element which is laid out as `f` of the
+// column that lines are currently indented to.
+func WithIndent(f func(indent int) Element) Element {
+	return &dynamic{kind: dynamicIndent, f: f}
+}
+
+type annotation struct {
+	value interface{}
+	child Element
+}
+
+func (d *annotation) Width() int {
+	return d.child.Width()
+}
+
+func (d *annotation) String() string {
+	return fmt.Sprintf(`Annotate(%v,%s)`, d.value, d.child.String())
+}
+
+func (d *annotation) private() {
+}
+
+// Annotate marks `e` with `ann`; what that means is up to the output.
+// It might be what kind of token `e` is, for instance, so that it can
+// be highlighted.  It makes no difference to the layout.  The Sink
+// the document is rendered to is told where each annotation starts and
+// ends.  Annotations are only reported once there's text in them, so
+// that indentation never ends up inside one, and those with no text at
+// all aren't reported.
+func Annotate(ann interface{}, e Element) Element {
+	return &annotation{value: ann, child: e}
+}
+
+type mark struct {
+	id    interface{}
+	child Element
+}
+
+func (d *mark) Width() int {
+	return d.child.Width()
+}
+
+func (d *mark) String() string {
+	return fmt.Sprintf(`Mark(%v,%s)`, d.id, d.child.String())
+}
+
+func (d *mark) private() {
+}
+
+// Mark records where `e` ends up in the output under `id`, for
+// RenderMarks.  Like an annotation, it makes no difference to the
+// layout, and it starts with the first text in `e` rather than any
+// indentation before it.
+func Mark(id interface{}, e Element) Element {
+	return &mark{id: id, child: e}
+}
+
+// A Token is an annotation saying what kind of token some text is, for
+// syntax highlighting.
+type Token string
+
+// The tokens that most languages have.
+const (
+	KeywordToken Token = "keyword"
+	StringToken  Token = "string"
+	NumberToken  Token = "number"
+	CommentToken Token = "comment"
+	ErrorToken   Token = "error"
+)
+
+type verbatim struct {
+	text    string
+	literal bool
+	// expansion is the text split up into lines, which is what
+	// actually gets printed.
+	expansion Element
+}
+
+func (d *verbatim) Width() int {
+	w := 0
+	for _, line := range strings.Split(d.text, "\n") {
+		if lw := MeasureCells(line); lw > w {
+			w = lw
+		}
+	}
+	return w
+}
+
+func (d *verbatim) String() string {
+	if d.literal {
+		return fmt.Sprintf(`Literal("%s")`, d.text)
+	}
+	return fmt.Sprintf(`Verbatim("%s")`, d.text)
+}
+
+func (d *verbatim) private() {
+}
+
+// Verbatim constructs an Element for text which may run over several
+// lines.  Each line is measured on its own, and lines after the first
+// are indented to the current nesting level, like after an LB; any
+// indentation already in `payload` comes after that.  "\r\n" counts
+// as a line ending too, and all of them are printed as the renderer's
+// Newline.
+func Verbatim(payload string) Element {
+	return newVerbatim(payload, false, LB)
+}
+
+// Literal is like Verbatim, except that lines after the first start at
+// the left margin whatever the nesting level, so that they come out
+// exactly as in `payload`; for instance heredocs, or multi-line string
+// literals.  Any Prefix is still printed at the start of each line.
+func Literal(payload string) Element {
+	return newVerbatim(payload, true, literalLB)
+}
+
+func newVerbatim(payload string, literal bool, lb Element) Element {
+	lines := strings.Split(payload, "\n")
+	children := make([]Element, 0, 2*len(lines))
+	for i, line := range lines {
+		if i > 0 {
+			children = append(children, lb)
+		}
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			children = append(children, Text(line))
+		}
+	}
+	return &verbatim{text: payload, literal: literal,
+		expansion: Concat(children...)}
+}
+
 type concat struct {
 	children []Element
 }
@@ -103,6 +449,11 @@ func Concat(elements ...Element) Element {
 
 type group struct {
 	child Element
+	// firstLine is true if the group is only measured up to its
+	// first hard line break, like an alternative of a FirstFit; Fill
+	// groups separators with the content after them this way when
+	// that content breaks the line.
+	firstLine bool
 }
 
 func (d *group) Width() int {
@@ -146,6 +497,195 @@ func Nest(element Element) Element {
 	return &nest{child: element}
 }
 
+type fill struct {
+	children []Element
+	// expansion is the equivalent document made out of groups,
+	// which is what actually gets printed.
+	expansion Element
+}
+
+func (d *fill) Width() int {
+	w := 0
+	for _, elt := range d.children {
+		w += elt.Width()
+	}
+	return w
+}
+
+func (d *fill) String() string {
+	w := "Fill("
+	for _, elt := range d.children {
+		w += elt.String()
+	}
+	return w + ")"
+}
+
+func (d *fill) private() {
+}
+
+// Fill lays out `elements` like a paragraph.  They alternate between
+// content and separators, starting with content; each separator
+// (typically a `Cond`) only breaks if the content after it wouldn't
+// fit on the line otherwise.  This is Oppen's "inconsistent" breaking,
+// as opposed to the consistent breaking of `Group`.  Content which
+// ends the line, with a LineSuffix say, breaks the separator after it
+// instead, as long as its first line fits.
+func Fill(elements ...Element) Element {
+	// Each separator is grouped with the content after it, so it
+	// only breaks if that doesn't fit.  If the content breaks the
+	// line, it's the separator after it which has to break; the one
+	// before only needs the content's first line to fit.
+	expansion := make([]Element, 0, 1+len(elements)/2)
+	if len(elements) > 0 {
+		expansion = append(expansion, elements[0])
+	}
+	for i := 1; i < len(elements); i += 2 {
+		forced := forcesBreak(elements[i-1])
+		if i+1 >= len(elements) {
+			if forced {
+				expansion = append(expansion, Group(Concat(BreakParent, elements[i])))
+			} else {
+				expansion = append(expansion, Group(elements[i]))
+			}
+		} else if forced {
+			expansion = append(expansion, Group(Concat(BreakParent, elements[i],
+				elements[i+1])))
+		} else if forcesBreak(elements[i+1]) {
+			expansion = append(expansion, &group{child: Concat(elements[i],
+				elements[i+1]), firstLine: true})
+		} else {
+			expansion = append(expansion, Group(Concat(elements[i], elements[i+1])))
+		}
+	}
+	return &fill{children: elements, expansion: Concat(expansion...)}
+}
+
+// forcesBreak reports whether the line always ends somewhere in `e`:
+// it has a hard line break in it, or a BreakParent or LineSuffix.
+// Only the first alternative of a Choice and the flat one of an
+// IfBreak count, since those are what's measured.
+func forcesBreak(e Element) bool {
+	switch d := e.(type) {
+	case *linebreak, *breakParent, *lineSuffix:
+		return true
+	case *concat:
+		for _, child := range d.children {
+			if forcesBreak(child) {
+				return true
+			}
+		}
+	case *fill:
+		return forcesBreak(d.expansion)
+	case *cond:
+		return forcesBreak(d.expansion)
+	case *verbatim:
+		return forcesBreak(d.expansion)
+	case *ifBreak:
+		return forcesBreak(d.flat)
+	case *choice:
+		return forcesBreak(d.alternatives[0])
+	case *group:
+		return forcesBreak(d.child)
+	case *nest:
+		return forcesBreak(d.child)
+	case *align:
+		return forcesBreak(d.child)
+	case *indent:
+		return forcesBreak(d.child)
+	case *prefix:
+		return forcesBreak(d.child)
+	case *annotation:
+		return forcesBreak(d.child)
+	case *mark:
+		return forcesBreak(d.child)
+	}
+	return false
+}
+
+type indent struct {
+	offset int
+	child  Element
+}
+
+func (d *indent) Width() int {
+	return d.child.Width()
+}
+
+func (d *indent) String() string {
+	return fmt.Sprintf(`Indent(%d,%s)`, d.offset, d.child.String())
+}
+
+func (d *indent) private() {
+}
+
+// Indent wraps `element` so that any line break within it is indented
+// `n` columns more than the enclosing `Nest` or `Indent` would have
+// it, rather than lining up with where `element` starts.  Unlike
+// `Nest`, it doesn't group `element`; wrap it in `Group` if line break
+// decisions within it should be consistent.
+func Indent(n int, element Element) Element {
+	return &indent{offset: n, child: element}
+}
+
+type align struct {
+	offset int
+	child  Element
+}
+
+func (d *align) Width() int {
+	return d.child.Width()
+}
+
+func (d *align) String() string {
+	if d.offset == 0 {
+		return fmt.Sprintf(`Align(%s)`, d.child.String())
+	}
+	return fmt.Sprintf(`Hang(%d,%s)`, d.offset, d.child.String())
+}
+
+func (d *align) private() {
+}
+
+// Align wraps `element` so that any line break within it lines up with
+// the start of `element`.  It's `Nest` without the grouping.
+func Align(element Element) Element {
+	return &align{child: element}
+}
+
+// Hang wraps `element` so that any line break within it is indented
+// `n` columns from the start of `element`; `n` may be negative, for
+// instance to outdent labels.  Like `Align`, it doesn't group
+// `element`.
+func Hang(n int, element Element) Element {
+	return &align{offset: n, child: element}
+}
+
+type prefix struct {
+	prefix string
+	child  Element
+}
+
+func (d *prefix) Width() int {
+	return d.child.Width()
+}
+
+func (d *prefix) String() string {
+	return fmt.Sprintf(`Prefix("%s",%s)`, d.prefix, d.child.String())
+}
+
+func (d *prefix) private() {
+}
+
+// Prefix wraps `element` so that every line break within it is
+// followed by `p`, for instance "// " to make a comment, and then any
+// indentation.  The prefix goes where the enclosing `Nest` or `Indent`
+// would have put the next line, and lines within `element` are
+// indented relative to the end of the prefix.  It isn't written at
+// the start of `element`.
+func Prefix(p string, element Element) Element {
+	return &prefix{prefix: p, child: element}
+}
+
 var (
 	// Empty is a convenience variable for an empty Element.
 	Empty = Text("")
@@ -157,4 +697,12 @@ var (
 	DotLB = Cond(".", ".", "")
 	// LB is an unconditional line break.
 	LB = new(linebreak)
+
+	// BreakParent prints nothing, but breaks every Group and Nest
+	// around it, just like an LB would.  It's no use inside the
+	// broken variant of an IfBreak, since that doesn't count towards
+	// whether the groups around it fit.
+	BreakParent Element = new(breakParent)
+
+	literalLB = &linebreak{literal: true}
 )
@@ -0,0 +1,153 @@
+package pprint
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Measurer reports how many columns `s` takes up when printed.
+// Layout decisions are only as good as the Measurer; the default,
+// MeasureCells, is right for most terminals and editors.
+type Measurer func(s string) int
+
+var (
+	// MeasureBytes counts every byte as a column.  It's the fastest,
+	// and exact if all the text is ASCII.
+	MeasureBytes Measurer = func(s string) int { return len(s) }
+	// MeasureRunes counts every Unicode code point as a column.
+	MeasureRunes Measurer = utf8.RuneCountInString
+	// MeasureCells counts the cells a terminal would use to display
+	// `s`: East Asian wide characters and emoji take two, combining
+	// marks and other zero width characters take none, and each
+	// grapheme cluster is only counted once.
+	MeasureCells Measurer = cellWidth
+)
+
+// withTabs adjusts `m` so that tabs count for `width` columns.
+func (m Measurer) withTabs(width int) Measurer {
+	return func(s string) int {
+		return m(s) + strings.Count(s, "\t")*(width-1)
+	}
+}
+
+func cellWidth(s string) int {
+	// Printable ASCII is a column a character; anything else, control
+	// characters included, goes the long way round.
+	i := 0
+	for i < len(s) && s[i] < utf8.RuneSelf && s[i] != 0x7f &&
+		(s[i] >= 0x20 || s[i] == '\t') {
+		i++
+	}
+	if i == len(s) {
+		return len(s)
+	}
+	w := i
+	// joined is true after a zero width joiner, when the next
+	// character is part of the same cluster; flag is true after an
+	// unpaired regional indicator.
+	joined, flag := false, false
+	for _, r := range s[i:] {
+		switch {
+		case joined:
+			joined = false
+		case r == zeroWidthJoiner:
+			joined = true
+		case unicode.Is(regionalIndicator, r):
+			if !flag {
+				w += 2
+			}
+			flag = !flag
+			continue
+		case r == '\t':
+			w++
+		case unicode.Is(zeroWidth, r), unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf, unicode.Cc):
+		case unicode.Is(wide, r):
+			w += 2
+		default:
+			w++
+		}
+		flag = false
+	}
+	return w
+}
+
+const zeroWidthJoiner = '\u200d'
+
+var regionalIndicator = &unicode.RangeTable{
+	R32: []unicode.Range32{{Lo: 0x1f1e6, Hi: 0x1f1ff, Stride: 1}},
+}
+
+// zeroWidth holds characters which extend the previous grapheme
+// cluster without being marks: Hangul medial vowels and final
+// consonants, and emoji skin tone modifiers.
+var zeroWidth = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1160, Hi: 0x11ff, Stride: 1},
+		{Lo: 0xd7b0, Hi: 0xd7ff, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f3fb, Hi: 0x1f3ff, Stride: 1},
+	},
+}
+
+// wide holds the East Asian Wide and Fullwidth characters, and the
+// emoji which are presented as such by default.
+var wide = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115f, Stride: 1},
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x2329, Hi: 0x232a, Stride: 1},
+		{Lo: 0x23e9, Hi: 0x23ec, Stride: 1},
+		{Lo: 0x23f0, Hi: 0x23f3, Stride: 3},
+		{Lo: 0x25fd, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2615, Stride: 1},
+		{Lo: 0x2648, Hi: 0x2653, Stride: 1},
+		{Lo: 0x267f, Hi: 0x2693, Stride: 0x14},
+		{Lo: 0x26a1, Hi: 0x26a1, Stride: 1},
+		{Lo: 0x26aa, Hi: 0x26ab, Stride: 1},
+		{Lo: 0x26bd, Hi: 0x26be, Stride: 1},
+		{Lo: 0x26c4, Hi: 0x26c5, Stride: 1},
+		{Lo: 0x26ce, Hi: 0x26d4, Stride: 6},
+		{Lo: 0x26ea, Hi: 0x26ea, Stride: 1},
+		{Lo: 0x26f2, Hi: 0x26f3, Stride: 1},
+		{Lo: 0x26f5, Hi: 0x26fa, Stride: 5},
+		{Lo: 0x26fd, Hi: 0x2705, Stride: 8},
+		{Lo: 0x270a, Hi: 0x270b, Stride: 1},
+		{Lo: 0x2728, Hi: 0x274c, Stride: 0x24},
+		{Lo: 0x274e, Hi: 0x274e, Stride: 1},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27b0, Hi: 0x27bf, Stride: 0xf},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b55, Stride: 5},
+		{Lo: 0x2e80, Hi: 0x303e, Stride: 1},
+		{Lo: 0x3041, Hi: 0x33ff, Stride: 1},
+		{Lo: 0x3400, Hi: 0x4dbf, Stride: 1},
+		{Lo: 0x4e00, Hi: 0xa4cf, Stride: 1},
+		{Lo: 0xa960, Hi: 0xa97f, Stride: 1},
+		{Lo: 0xac00, Hi: 0xd7a3, Stride: 1},
+		{Lo: 0xf900, Hi: 0xfaff, Stride: 1},
+		{Lo: 0xfe10, Hi: 0xfe19, Stride: 1},
+		{Lo: 0xfe30, Hi: 0xfe6f, Stride: 1},
+		{Lo: 0xff00, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x16fe0, Hi: 0x16fe4, Stride: 1},
+		{Lo: 0x17000, Hi: 0x18cff, Stride: 1},
+		{Lo: 0x1b000, Hi: 0x1b2ff, Stride: 1},
+		{Lo: 0x1f004, Hi: 0x1f0cf, Stride: 0xcb},
+		{Lo: 0x1f18e, Hi: 0x1f18e, Stride: 1},
+		{Lo: 0x1f191, Hi: 0x1f19a, Stride: 1},
+		{Lo: 0x1f200, Hi: 0x1f251, Stride: 1},
+		{Lo: 0x1f300, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f680, Hi: 0x1f6ff, Stride: 1},
+		{Lo: 0x1f7e0, Hi: 0x1f7eb, Stride: 1},
+		{Lo: 0x1f90c, Hi: 0x1f9ff, Stride: 1},
+		{Lo: 0x1fa70, Hi: 0x1faff, Stride: 1},
+		{Lo: 0x20000, Hi: 0x2fffd, Stride: 1},
+		{Lo: 0x30000, Hi: 0x3fffd, Stride: 1},
+	},
+}
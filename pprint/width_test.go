@@ -0,0 +1,71 @@
+package pprint
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMeasureCells(t *testing.T) {
+	assert.Equal(t, 0, MeasureCells(""))
+	assert.Equal(t, 5, MeasureCells("hello"))
+	assert.Equal(t, 4, MeasureCells("café"))
+	// e followed by a combining acute accent
+	assert.Equal(t, 4, MeasureCells("café"))
+	assert.Equal(t, 4, MeasureCells("日本"))
+	assert.Equal(t, 6, MeasureCells("한국어"))
+	// Hangul spelled out in jamo is still one syllable
+	assert.Equal(t, 2, MeasureCells("각"))
+	assert.Equal(t, 9, MeasureCells("ｆｕｌｌ!"))
+	assert.Equal(t, 2, MeasureCells("🎉"))
+	// thumbs up with a skin tone
+	assert.Equal(t, 2, MeasureCells("\U0001f44d\U0001f3fd"))
+	// family, joined with zero width joiners
+	assert.Equal(t, 2, MeasureCells("\U0001f469\u200d\U0001f469\u200d\U0001f467"))
+	// two flags
+	assert.Equal(t, 4, MeasureCells("\U0001f1ef\U0001f1f5\U0001f1eb\U0001f1f7"))
+	// a zero width space
+	assert.Equal(t, 1, MeasureCells("a\u200b"))
+	// control characters take up no room, whatever comes before them
+	assert.Equal(t, 5, MeasureCells("a\x1b[1mb"))
+	assert.Equal(t, 5, MeasureCells("é\x1b[1mb"))
+	assert.Equal(t, 2, MeasureCells("a\x7f\x01b"))
+	assert.Equal(t, 3, MeasureCells("a\tb"))
+}
+
+func TestMeasurers(t *testing.T) {
+	assert.Equal(t, 6, MeasureBytes("日本"))
+	assert.Equal(t, 2, MeasureRunes("日本"))
+	assert.Equal(t, 4, MeasureCells("日本"))
+	assert.Equal(t, 4, Text("日本").Width())
+	assert.Equal(t, 2, Cond("日", "", "").Width())
+}
+
+func TestUnicodeLayout(t *testing.T) {
+	handle := Group(Concat(Text("名前"), CondLB, Text("café")))
+
+	for _, c := range []struct {
+		measure Measurer
+		width   int
+		out     string
+	}{
+		{MeasureCells, 9, "名前 café"},
+		{MeasureCells, 8, "名前\ncafé"},
+		{MeasureRunes, 7, "名前 café"},
+		{MeasureRunes, 6, "名前\ncafé"},
+		{MeasureBytes, 12, "名前 café"},
+		{MeasureBytes, 11, "名前\ncafé"},
+	} {
+		out, err := RenderOutput(handle, Options{Width: c.width,
+			Measure: c.measure})
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.out, out)
+		}
+	}
+
+	// Indentation follows the display width too.
+	handle = Concat(Text("日本"), CSV(Text("a"), Text("b")))
+	out, err := Output(handle, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "日本a,\n    b", out)
+	}
+}